@@ -0,0 +1,128 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+//migrateBatchSize is the number of counters rewritten per transaction by migrations
+const migrateBatchSize = 256
+
+//MigrateBlockSizes rewrites counters of the first format version to include the size of their stored block.
+//It is safe to run on a live store.
+//It returns the number of counters migrated.
+func (c *Counted) MigrateBlockSizes(ctx context.Context) (int, error) {
+	rs, err := c.ds.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	es, err := rs.Rest()
+	if err != nil {
+		return 0, err
+	}
+	var ids []cid.Cid
+	for _, e := range es {
+		if id, err := c.keyToCid(e.Key, counterSuffixKey); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	migrated := 0
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > migrateBatchSize {
+			batch = batch[:migrateBatchSize]
+		}
+		ids = ids[len(batch):]
+		var n int
+		if err := c.txWarp(ctx, func(tx *Tx) error {
+			n = 0
+			for _, id := range batch {
+				count, meta, key, err := c.getCount(tx.transaction, id)
+				if err != nil {
+					return err
+				}
+				if !meta.HavePart || meta.SizeKnown {
+					continue
+				}
+				size, err := tx.transaction.GetSize(c.dataKey(id))
+				if err == datastore.ErrNotFound {
+					continue //left for Fsck
+				}
+				if err != nil {
+					return err
+				}
+				meta.Size, meta.SizeKnown = uint64(size), true
+				if err := setCount(tx.transaction, key, count, meta); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		}); err != nil {
+			return migrated, err
+		}
+		migrated += n
+	}
+	return migrated, nil
+}
+
+//BlockStats is the number and total size of the blocks in a store.
+type BlockStats struct {
+	//Blocks is the number of stored blocks
+	Blocks uint64
+	//Bytes is the total size of the blocks with a known size
+	Bytes uint64
+	//UnknownSize is the number of blocks with a counter without a size, see MigrateBlockSizes
+	UnknownSize uint64
+}
+
+//BlockStats scans all counters for the number and size of stored blocks, without reading their data.
+//In LayoutMultihash data shared by several cids is counted once.
+func (c *Counted) BlockStats(ctx context.Context) (BlockStats, error) {
+	var stats BlockStats
+	rs, err := c.ds.Query(query.Query{Prefix: c.keys.kindPrefix(c.blockMetaSuffix())})
+	if err != nil {
+		return stats, err
+	}
+	defer rs.Close()
+	for r := range rs.Next() {
+		if r.Error != nil {
+			return stats, r.Error
+		}
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		id, err := c.keyToCid(r.Key, c.blockMetaSuffix())
+		if err != nil || isIdentity(id) {
+			continue
+		}
+		_, meta, err := decodeCounter(r.Value)
+		if err != nil || !meta.HavePart {
+			continue
+		}
+		stats.Blocks++
+		if meta.SizeKnown {
+			stats.Bytes += meta.Size
+		} else {
+			stats.UnknownSize++
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+)
+
+func TestBlockSize(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	store, err := NewCountedStore(db, nil)
+	fatalIfErr(t, err)
+
+	checkSizes := func(stored []cid.Cid) {
+		t.Helper()
+		for _, id := range stored {
+			data, err := getter.GetBlock(ctx, id)
+			fatalIfErr(t, err)
+			size, err := store.GetBlockSize(ctx, id)
+			fatalIfErr(t, err)
+			if size != len(data) {
+				t.Errorf("expected size %v for %v, got %v", len(data), id, size)
+			}
+		}
+	}
+
+	checkStats := func(want BlockStats) {
+		t.Helper()
+		stats, err := store.BlockStats(ctx)
+		fatalIfErr(t, err)
+		if stats != want {
+			t.Errorf("expected block stats %+v, got %+v", want, stats)
+		}
+	}
+
+	checkStats(BlockStats{})
+	_, err = store.Increment(ctx, cids[0], getter)
+	fatalIfErr(t, err)
+	stored := []cid.Cid{cids[0], cids[3], cids[5]}
+	checkSizes(stored)
+	var total uint64
+	for _, id := range stored {
+		data, err := getter.GetBlock(ctx, id)
+		fatalIfErr(t, err)
+		total += uint64(len(data))
+	}
+	checkStats(BlockStats{Blocks: 3, Bytes: total})
+	if _, err := store.GetBlockSize(ctx, cids[1]); err != datastore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound for a block not stored, got %v", err)
+	}
+
+	//downgrade to counters without sizes and data without a header, they are still served from the data
+	for _, id := range stored {
+		count, meta, key, err := store.getCount(db, id)
+		fatalIfErr(t, err)
+		meta.Size, meta.SizeKnown = 0, false
+		fatalIfErr(t, setCount(db, key, count, meta))
+		data, err := getter.GetBlock(ctx, id)
+		fatalIfErr(t, err)
+		fatalIfErr(t, store.setData(db, id, data))
+	}
+	checkSizes(stored)
+	checkStats(BlockStats{Blocks: 3, UnknownSize: 3})
+	n, err := store.MigrateBlockSizes(ctx)
+	fatalIfErr(t, err)
+	if n != len(stored) {
+		t.Fatalf("expected %v counters migrated, got %v", len(stored), n)
+	}
+	for _, id := range stored {
+		_, meta, _, err := store.getCount(db, id)
+		fatalIfErr(t, err)
+		if !meta.SizeKnown {
+			t.Errorf("expected size of %v after migration", id)
+		}
+	}
+	checkSizes(stored)
+	checkStats(BlockStats{Blocks: 3, Bytes: total})
+	if n, err := store.MigrateBlockSizes(ctx); n != 0 || err != nil {
+		t.Fatalf("expected nothing left to migrate, got %v, %v", n, err)
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/pkg/errors"
+)
+
+//ChangeKind is the type of a Change.
+type ChangeKind uint8
+
+const (
+	//ChangeBlockStored is when the data of a block is saved.
+	ChangeBlockStored ChangeKind = iota + 1
+	//ChangeBlockDeleted is when the data of a block is deleted.
+	ChangeBlockDeleted
+	//ChangeTagPut is when a new tag is added to a cid.
+	ChangeTagPut
+	//ChangeTagRemoved is when a tag is removed from a cid.
+	ChangeTagRemoved
+	//ChangeCount is when the counter of a cid is changed, Count is the new value.
+	ChangeCount
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeBlockStored:
+		return "BlockStored"
+	case ChangeBlockDeleted:
+		return "BlockDeleted"
+	case ChangeTagPut:
+		return "TagPut"
+	case ChangeTagRemoved:
+		return "TagRemoved"
+	case ChangeCount:
+		return "Count"
+	default:
+		return "ChangeKind(" + strconv.Itoa(int(k)) + ")"
+	}
+}
+
+//Change is a logical change to the store.
+type Change struct {
+	//Seq is the sequence number of the change in the change log, it is only set if
+	// DatabaseOptions.ChangeLog is enabled.
+	Seq   uint64
+	Kind  ChangeKind
+	Cid   cid.Cid
+	Tag   datastore.Key //only set for ChangeTagPut and ChangeTagRemoved
+	Count int64         //only set for ChangeCount
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%v %v %v tag:%v count:%v", c.Seq, c.Kind, c.Cid, c.Tag, c.Count)
+}
+
+var changeLogKey = datastore.NewKey("/changes/log")
+var changeSeqKey = datastore.NewKey("/changes/seq")
+
+func getChangeKey(seq uint64) datastore.Key {
+	return changeLogKey.ChildString(fmt.Sprintf("%016x", seq))
+}
+
+func (c Change) encode() []byte {
+	idLen := c.Cid.ByteLen()
+	buf := make([]byte, 1+2*binary.MaxVarintLen64, 1+2*binary.MaxVarintLen64+idLen+len(c.Tag.String()))
+	buf[0] = byte(c.Kind)
+	n := 1 + binary.PutUvarint(buf[1:], uint64(c.Count))
+	n += binary.PutUvarint(buf[n:], uint64(idLen))
+	buf = append(buf[:n], c.Cid.Bytes()...)
+	if c.Kind == ChangeTagPut || c.Kind == ChangeTagRemoved {
+		buf = append(buf, c.Tag.String()...)
+	}
+	return buf
+}
+
+func decodeChange(seq uint64, bs []byte) (Change, error) {
+	ch := Change{Seq: seq}
+	if len(bs) < 1 {
+		return ch, errors.Errorf("corrupted change %v: empty", seq)
+	}
+	ch.Kind = ChangeKind(bs[0])
+	count, n := binary.Uvarint(bs[1:])
+	if n <= 0 {
+		return ch, errors.Errorf("corrupted change %v: bad count, from raw `%x`", seq, bs)
+	}
+	ch.Count = int64(count)
+	bs = bs[1+n:]
+	idLen, n := binary.Uvarint(bs)
+	if n <= 0 || uint64(len(bs)-n) < idLen {
+		return ch, errors.Errorf("corrupted change %v: bad cid length, from raw `%x`", seq, bs)
+	}
+	bs = bs[n:]
+	var err error
+	if ch.Cid, err = cid.Cast(bs[:idLen]); err != nil {
+		return ch, errors.Wrapf(err, "corrupted change %v", seq)
+	}
+	if len(bs) > int(idLen) {
+		ch.Tag = datastore.RawKey(string(bs[idLen:]))
+	}
+	return ch, nil
+}
+
+func getLastChangeSeq(db datastore.Read) (uint64, error) {
+	v, err := db.Get(changeSeqKey)
+	if err == datastore.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	seq, n := binary.Uvarint(v)
+	if n <= 0 || n != len(v) {
+		return 0, errors.Errorf("corrupted change sequence, from raw `%x`", v)
+	}
+	return seq, nil
+}
+
+//record adds a change made in the transaction to the change log, and keeps it for Hooks until commit.
+func (c *Tx) record(ch Change) error {
+	c.changed.add(ch)
+	if c.store.opt.ChangeLog {
+		if err := c.appendChange(&ch); err != nil {
+			return err
+		}
+	}
+	if c.store.opt.Hooks != nil && ch.Kind != ChangeCount {
+		c.events = append(c.events, ch)
+	}
+	return nil
+}
+
+//appendChange writes ch to the change log with the next sequence number.
+//Replicas rely on sequence numbers without gaps, so every transaction with changes reads and updates
+// changeSeqKey, concurrent writers conflict on it and are retried by the RetryPolicy.
+func (c *Tx) appendChange(ch *Change) error {
+	if c.lastSeq == 0 {
+		seq, err := getLastChangeSeq(c.transaction)
+		if err != nil {
+			return err
+		}
+		c.lastSeq = seq
+	}
+	c.lastSeq++
+	ch.Seq = c.lastSeq
+	key := getChangeKey(ch.Seq)
+	value, err := c.store.sealMarked(ch.encode(), key.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := c.transaction.Put(key, value); err != nil {
+		return err
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	return c.transaction.Put(changeSeqKey, buf[:binary.PutUvarint(buf, ch.Seq)])
+}
+
+//ChangeIterator is an iterator of changes in sequence order.
+type ChangeIterator interface {
+	//NextChange returns the next change or io.EOF if the end is reached
+	NextChange() (Change, error)
+	//Close releases the resources used by this iterator for early exist
+	Close() error
+}
+
+type changeIter struct {
+	store *Counted
+	rs    query.Results
+	err   error
+}
+
+func (c *changeIter) NextChange() (Change, error) {
+	if c.err != nil {
+		return Change{}, c.err
+	}
+	r, more := c.rs.NextSync()
+	if r.Error != nil {
+		return Change{}, r.Error
+	}
+	if !more {
+		c.err = io.EOF
+		return Change{}, c.err
+	}
+	seq, err := strconv.ParseUint(datastore.RawKey(r.Key).BaseNamespace(), 16, 64)
+	if err != nil {
+		return Change{}, errors.Wrapf(err, "corrupted change key %v", r.Key)
+	}
+	value, err := c.store.openMarked(r.Value, datastore.RawKey(r.Key).Bytes())
+	if err != nil {
+		return Change{}, err
+	}
+	return decodeChange(seq, value)
+}
+
+func (c *changeIter) Close() error {
+	if c.rs == nil {
+		return c.err
+	}
+	return c.rs.Close()
+}
+
+//Changes iterates the change log starting from the change with sequence number fromSeq.
+//The change log is only written if DatabaseOptions.ChangeLog is enabled.
+func (c *Counted) Changes(fromSeq uint64) ChangeIterator {
+	it := &changeIter{store: c}
+	it.rs, it.err = c.ds.Query(query.Query{
+		Prefix: changeLogKey.String(),
+		Filters: []query.Filter{query.FilterKeyCompare{
+			Op:  query.GreaterThanOrEqual,
+			Key: getChangeKey(fromSeq).String(),
+		}},
+		Orders: []query.Order{query.OrderByKey{}},
+	})
+	return it
+}
+
+//LastChangeSeq returns the sequence number of the last change, or 0 if there are none.
+func (c *Counted) LastChangeSeq(ctx context.Context) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return getLastChangeSeq(c.ds)
+}
+
+//truncateBatchSize is the maximum number of changes deleted in one transaction
+const truncateBatchSize = 1024
+
+//TruncateChanges deletes all changes with sequence numbers less than beforeSeq.
+//Sequence numbers are never reused after truncation.
+func (c *Counted) TruncateChanges(ctx context.Context, beforeSeq uint64) error {
+	for {
+		rs, err := c.ds.Query(query.Query{
+			Prefix: changeLogKey.String(),
+			Filters: []query.Filter{query.FilterKeyCompare{
+				Op:  query.LessThan,
+				Key: getChangeKey(beforeSeq).String(),
+			}},
+			Orders:   []query.Order{query.OrderByKey{}},
+			Limit:    truncateBatchSize,
+			KeysOnly: true,
+		})
+		if err != nil {
+			return err
+		}
+		es, err := rs.Rest()
+		if err != nil {
+			return err
+		}
+		if len(es) == 0 {
+			return nil
+		}
+		if err := c.txWarp(ctx, func(tx *Tx) error {
+			for _, e := range es {
+				if err := tx.transaction.Delete(datastore.RawKey(e.Key)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+}
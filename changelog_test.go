@@ -0,0 +1,142 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+)
+
+func TestChangeLog(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	//conflicts should not leave changes in the log
+	db := newConflictDatastore(t, 1)
+	defer db.Close()
+	store, err := NewTagCountedStore(db, &DatabaseOptions{ChangeLog: true})
+	fatalIfErr(t, err)
+	ctx := context.Background()
+	tag := datastore.NewKey("tag")
+
+	fatalIfErr(t, store.PutTag(ctx, cids[0], tag, getter))
+	fatalIfErr(t, store.RemoveTag(ctx, cids[0], tag))
+	expected := []Change{
+		{Seq: 1, Kind: ChangeTagPut, Cid: cids[0], Tag: tag},
+		{Seq: 2, Kind: ChangeCount, Cid: cids[0], Count: 1},
+		{Seq: 3, Kind: ChangeBlockStored, Cid: cids[0]},
+		{Seq: 4, Kind: ChangeCount, Cid: cids[3], Count: 1},
+		{Seq: 5, Kind: ChangeBlockStored, Cid: cids[3]},
+		{Seq: 6, Kind: ChangeCount, Cid: cids[5], Count: 1},
+		{Seq: 7, Kind: ChangeBlockStored, Cid: cids[5]},
+		{Seq: 8, Kind: ChangeTagRemoved, Cid: cids[0], Tag: tag},
+		{Seq: 9, Kind: ChangeCount, Cid: cids[0], Count: 0},
+		{Seq: 10, Kind: ChangeBlockDeleted, Cid: cids[0]},
+		{Seq: 11, Kind: ChangeCount, Cid: cids[3], Count: 0},
+		{Seq: 12, Kind: ChangeBlockDeleted, Cid: cids[3]},
+		{Seq: 13, Kind: ChangeCount, Cid: cids[5], Count: 0},
+		{Seq: 14, Kind: ChangeBlockDeleted, Cid: cids[5]},
+	}
+	checkChanges(t, store.Changes(0), expected)
+	checkChanges(t, store.Changes(9), expected[8:])
+
+	fatalIfErr(t, store.TruncateChanges(ctx, 12))
+	checkChanges(t, store.Changes(0), expected[11:])
+	last, err := store.LastChangeSeq(ctx)
+	fatalIfErr(t, err)
+	if last != 14 {
+		t.Errorf("expected last sequence 14, got %v", last)
+	}
+	fatalIfErr(t, store.TruncateChanges(ctx, 100))
+	checkChanges(t, store.Changes(0), nil)
+
+	//sequence numbers are not reused after truncation
+	fatalIfErr(t, store.PutTag(ctx, cids[5], tag, getter))
+	checkChanges(t, store.Changes(0), []Change{
+		{Seq: 15, Kind: ChangeTagPut, Cid: cids[5], Tag: tag},
+		{Seq: 16, Kind: ChangeCount, Cid: cids[5], Count: 1},
+		{Seq: 17, Kind: ChangeBlockStored, Cid: cids[5]},
+	})
+}
+
+func checkChanges(t testing.TB, it ChangeIterator, expected []Change) {
+	t.Helper()
+	defer it.Close()
+	for i := 0; ; i++ {
+		ch, err := it.NextChange()
+		if err == io.EOF {
+			if i != len(expected) {
+				t.Fatalf("expected %v changes, got %v", len(expected), i)
+			}
+			return
+		}
+		fatalIfErr(t, err)
+		if i >= len(expected) {
+			t.Fatalf("unexpected change %v", ch)
+		}
+		if ch.String() != expected[i].String() {
+			t.Errorf("expected change %v, got %v", expected[i], ch)
+		}
+	}
+}
+
+func TestChangeLogConcurrent(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	store, err := NewTagCountedStore(db, &DatabaseOptions{ChangeLog: true})
+	fatalIfErr(t, err)
+	ctx := context.Background()
+
+	//writers are serialized by the sequence, which has no gaps
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := store.PutTag(ctx, cids[i%len(cids)], datastore.NewKey(strconv.Itoa(i)), getter); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	it := store.Changes(0)
+	defer it.Close()
+	var seq uint64
+	for {
+		ch, err := it.NextChange()
+		if err == io.EOF {
+			break
+		}
+		fatalIfErr(t, err)
+		if seq++; ch.Seq != seq {
+			t.Fatalf("expected change %v, got %v", seq, ch)
+		}
+	}
+	last, err := store.LastChangeSeq(ctx)
+	fatalIfErr(t, err)
+	if last != seq || seq == 0 {
+		t.Fatalf("expected last sequence %v, got %v", seq, last)
+	}
+}
@@ -0,0 +1,383 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+
+	"github.com/golang/snappy"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+//Compressor compresses block data before it is written to the datastore.
+type Compressor interface {
+	//ID is written in the header of each compressed value, it must be unique and not 0.
+	ID() byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+//Snappy is a Compressor using snappy block compression, values written by it can always be read.
+var Snappy Compressor = snappyCompressor{}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) ID() byte {
+	return 1
+}
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCompressor) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+//Zstd is a Compressor using zstd at its default level, it compresses better than Snappy but is slower.
+//Values written by it can always be read.
+var Zstd Compressor = zstdCompressor{}
+
+type zstdCompressor struct{}
+
+//zstdEncoder and zstdDecoder are only used with EncodeAll and DecodeAll, which can be called concurrently.
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+func (zstdCompressor) ID() byte {
+	return 2
+}
+
+func (zstdCompressor) Compress(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+func (zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	return zstdDecoder.DecodeAll(data, nil)
+}
+
+//Data values start with a header, so they can be read without their counter:
+// a byte of dataHeader with the dataSealed flag, then the ID of the Compressor or 0 if not compressed.
+//The rest is the data, compressed if it has a Compressor ID, then sealed by the Keyring if dataSealed is set.
+//Values written before SchemaVersion 2 have no header, their encoding is only in their counter.
+const (
+	dataHeader     = 0xd0
+	dataHeaderMask = 0xfe
+	dataSealed     = 0x01
+	dataHeaderLen  = 2
+)
+
+//encodeData returns the value to store at key for the block data, and the stored block fields of its counter.
+//Data is stored uncompressed if compression is disabled or does not save space.
+func (c *Counted) encodeData(key datastore.Key, data []byte) ([]byte, metadata, error) {
+	stored := metadata{Size: uint64(len(data)), SizeKnown: true, Header: true}
+	value, compression := data, byte(0)
+	if c.opt.Compression != nil {
+		compressed, err := c.opt.Compression.Compress(data)
+		if err != nil {
+			return nil, metadata{}, err
+		}
+		if len(compressed) < len(data) {
+			value, compression, stored.Encoded = compressed, c.opt.Compression.ID(), true
+		}
+	}
+	header := byte(dataHeader)
+	if c.opt.Keyring != nil {
+		var err error
+		if value, err = c.seal(value, key.Bytes()); err != nil {
+			return nil, metadata{}, err
+		}
+		header |= dataSealed
+		stored.Encrypted = true
+	}
+	return append([]byte{header, compression}, value...), stored, nil
+}
+
+//readData decodes a value with a data header stored at key,
+// it returns the block data and the stored block fields of its counter.
+func (c *Counted) readData(key datastore.Key, value []byte) ([]byte, metadata, error) {
+	if len(value) < dataHeaderLen || value[0]&dataHeaderMask != dataHeader {
+		return nil, metadata{}, errors.New("data value is missing its header")
+	}
+	stored := metadata{Header: true, Encoded: value[1] != 0, Encrypted: value[0]&dataSealed != 0}
+	data := value[dataHeaderLen:]
+	if stored.Encrypted {
+		var err error
+		if data, _, err = c.open(data, key.Bytes()); err != nil {
+			return nil, metadata{}, err
+		}
+	}
+	if stored.Encoded {
+		var err error
+		if data, err = c.decompress(value[1], data); err != nil {
+			return nil, metadata{}, err
+		}
+	}
+	stored.Size, stored.SizeKnown = uint64(len(data)), true
+	return data, stored, nil
+}
+
+//decodeData returns the block data from a value stored at key.
+func (c *Counted) decodeData(key datastore.Key, value []byte, meta metadata) ([]byte, error) {
+	if meta.Header {
+		data, _, err := c.readData(key, value)
+		return data, err
+	}
+	if meta.Encrypted {
+		var err error
+		if value, _, err = c.open(value, key.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	if !meta.Encoded {
+		return value, nil
+	}
+	if len(value) == 0 {
+		return nil, errors.New("compressed value is missing its header")
+	}
+	return c.decompress(value[0], value[1:])
+}
+
+func (c *Counted) decompress(compression byte, data []byte) ([]byte, error) {
+	for _, comp := range append([]Compressor{c.opt.Compression, Snappy, Zstd}, c.opt.Decompressors...) {
+		if comp != nil && comp.ID() == compression {
+			return comp.Decompress(data)
+		}
+	}
+	return nil, errors.Errorf("no decompressor for compression id %v", compression)
+}
+
+//sealedData returns the part of a stored value that is sealed by the Keyring, and if it is sealed.
+func sealedData(value []byte, meta metadata) ([]byte, bool) {
+	if !meta.Header {
+		return value, meta.Encrypted
+	}
+	if len(value) < dataHeaderLen {
+		return nil, false
+	}
+	return value[dataHeaderLen:], value[0]&dataSealed != 0
+}
+
+//resealData seals the data of a value stored at from to be stored at to.
+func (c *Counted) resealData(value []byte, meta metadata, from, to datastore.Key) ([]byte, error) {
+	sealed, ok := sealedData(value, meta)
+	if !ok {
+		return value, nil
+	}
+	header := value[:len(value)-len(sealed)]
+	plain, _, err := c.open(sealed, from.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if sealed, err = c.seal(plain, to.Bytes()); err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), header...), sealed...), nil
+}
+
+//getData reads the stored data of a block and decompresses it.
+func (c *Counted) getData(db datastore.Read, id cid.Cid) ([]byte, error) {
+	key := c.dataKey(id)
+	value, err := db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	_, meta, _, err := c.getBlockMeta(db, id)
+	if err != nil {
+		return nil, err
+	}
+	return c.decodeData(key, value, meta)
+}
+
+//storedBlock finds the stored block fields of the data of id from its value, for data without a trusted counter.
+//Data written before SchemaVersion 2 has no header and may be stored next to data with one,
+// so the encodings are tried in turn and the first that decodes to the block of id is used.
+//Data that matches none of them is read from its header if it has one, or as uncompressed data.
+func (c *Counted) storedBlock(db datastore.Read, id cid.Cid) (metadata, error) {
+	key := c.dataKey(id)
+	value, err := db.Get(key)
+	if err != nil {
+		return metadata{}, err
+	}
+	data, stored, headerErr := c.readData(key, value)
+	if headerErr == nil && verifyBlock(c.dataID(id), data) == nil {
+		return stored, nil
+	}
+	for _, legacy := range []metadata{{}, {Encoded: true}, {Encrypted: true}, {Encoded: true, Encrypted: true}} {
+		data, err := c.decodeData(key, value, legacy)
+		if err == nil && verifyBlock(c.dataID(id), data) == nil {
+			legacy.Size, legacy.SizeKnown = uint64(len(data)), true
+			return legacy, nil
+		}
+	}
+	if headerErr == nil {
+		return stored, nil
+	}
+	return metadata{Size: uint64(len(value)), SizeKnown: true}, nil
+}
+
+//putData writes the data of a block, it returns the block fields of the counter metadata to save with it.
+//In LayoutMultihash they are also saved in the data refs record, which is created with one reference.
+func (c *Tx) putData(id cid.Cid, data []byte) (metadata, error) {
+	value, stored, err := c.store.encodeData(c.store.dataKey(id), data)
+	if err != nil {
+		return metadata{}, err
+	}
+	if err := c.transaction.Put(c.store.dataKey(id), value); err != nil {
+		return metadata{}, err
+	}
+	if c.store.opt.KeyLayout != LayoutMultihash {
+		return stored, nil
+	}
+	refs, meta, key, err := c.store.getBlockMeta(c.transaction, id)
+	if err != nil {
+		return metadata{}, err
+	}
+	if refs == 0 {
+		refs, meta = 1, metadata{Complete: true, HavePart: true}
+	}
+	return stored, setCount(c.transaction, key, refs, meta.withBlock(stored))
+}
+
+//MigrateDataHeaders rewrites the data of blocks stored before SchemaVersion 2 with a data header.
+//It is safe to run on a live store.
+//It returns the number of blocks migrated.
+func (c *Counted) MigrateDataHeaders(ctx context.Context) (int, error) {
+	rs, err := c.ds.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	es, err := rs.Rest()
+	if err != nil {
+		return 0, err
+	}
+	var ids []cid.Cid
+	for _, e := range es {
+		if id, err := c.keyToCid(e.Key, c.blockMetaSuffix()); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	migrated := 0
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > migrateBatchSize {
+			batch = batch[:migrateBatchSize]
+		}
+		ids = ids[len(batch):]
+		var n int
+		if err := c.txWarp(ctx, func(tx *Tx) error {
+			n = 0
+			for _, id := range batch {
+				count, meta, key, err := c.getBlockMeta(tx.transaction, id)
+				if err != nil {
+					return err
+				}
+				if !meta.HavePart || meta.Header {
+					continue
+				}
+				value, err := tx.transaction.Get(c.dataKey(id))
+				if err == datastore.ErrNotFound {
+					continue //left for Fsck
+				}
+				if err != nil {
+					return err
+				}
+				data, err := c.decodeData(c.dataKey(id), value, meta)
+				if err != nil {
+					return err
+				}
+				value, stored, err := c.encodeData(c.dataKey(id), data)
+				if err != nil {
+					return err
+				}
+				if err := tx.transaction.Put(c.dataKey(id), value); err != nil {
+					return err
+				}
+				if err := setCount(tx.transaction, key, count, meta.withBlock(stored)); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		}); err != nil {
+			return migrated, err
+		}
+		migrated += n
+	}
+	return migrated, nil
+}
+
+//CompressionStats reports the space saved by compression.
+type CompressionStats struct {
+	//Blocks is the number of stored blocks with a known size
+	Blocks uint64
+	//CompressedBlocks is the number of those blocks stored compressed
+	CompressedBlocks uint64
+	//Bytes is the total size of the blocks
+	Bytes uint64
+	//StoredBytes is the total size of the blocks as stored, including compression and encryption headers
+	StoredBytes uint64
+}
+
+//Saved returns the number of bytes saved by compression.
+func (s CompressionStats) Saved() int64 {
+	return int64(s.Bytes) - int64(s.StoredBytes)
+}
+
+//CompressionStats scans all counters for the compression savings of stored blocks.
+//Blocks of counters without a size are not included, see MigrateBlockSizes.
+func (c *Counted) CompressionStats(ctx context.Context) (CompressionStats, error) {
+	var stats CompressionStats
+	rs, err := c.ds.Query(query.Query{})
+	if err != nil {
+		return stats, err
+	}
+	defer rs.Close()
+	for r := range rs.Next() {
+		if r.Error != nil {
+			return stats, r.Error
+		}
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		id, err := c.keyToCid(r.Key, c.blockMetaSuffix())
+		if err != nil {
+			continue
+		}
+		_, meta, err := decodeCounter(r.Value)
+		if err != nil || !meta.HavePart || !meta.SizeKnown {
+			continue
+		}
+		stats.Blocks++
+		stats.Bytes += meta.Size
+		if !meta.Encoded && !meta.Encrypted {
+			stats.StoredBytes += meta.Size
+			continue
+		}
+		size, err := c.ds.GetSize(c.dataKey(id))
+		if err != nil {
+			return stats, err
+		}
+		if meta.Encoded {
+			stats.CompressedBlocks++
+		}
+		stats.StoredBytes += uint64(size)
+	}
+	return stats, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/ipfs/go-merkledag"
+)
+
+func TestCompression(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	text, err := merkledag.NewRawNodeWPrefix(bytes.Repeat([]byte("Hello World! "), 100), cidBuilder)
+	fatalIfErr(t, err)
+	file, err := createFile(text)
+	fatalIfErr(t, err)
+	textGetter := blockGetterFromBlocks(text, file)
+
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	plain, err := NewCountedStore(db, nil)
+	fatalIfErr(t, err)
+	_, err = plain.Increment(ctx, cids[0], getter)
+	fatalIfErr(t, err)
+	store, err := NewCountedStore(db, &DatabaseOptions{Compression: Snappy})
+	fatalIfErr(t, err)
+	_, err = store.Increment(ctx, file.Cid(), textGetter)
+	fatalIfErr(t, err)
+
+	stored, err := db.GetSize(store.getDataKey(text.Cid()))
+	fatalIfErr(t, err)
+	if stored >= len(text.RawData()) {
+		t.Fatalf("expected compressed size less than %v, got %v", len(text.RawData()), stored)
+	}
+
+	//both stores read compressed and uncompressed blocks
+	check := func(store *Counted, bs ...blocks.Block) {
+		t.Helper()
+		for _, b := range bs {
+			data, err := store.GetBlock(ctx, b.Cid())
+			fatalIfErr(t, err)
+			if !bytes.Equal(data, b.RawData()) {
+				t.Errorf("unexpected data for %v", b.Cid())
+			}
+			size, err := store.GetBlockSize(ctx, b.Cid())
+			fatalIfErr(t, err)
+			if size != len(b.RawData()) {
+				t.Errorf("expected size %v for %v, got %v", len(b.RawData()), b.Cid(), size)
+			}
+		}
+	}
+	hello, err := merkledag.NewRawNodeWPrefix([]byte("Hello World!"), cidBuilder)
+	fatalIfErr(t, err)
+	for _, s := range []*Counted{plain, store} {
+		check(s, text, file, hello)
+	}
+
+	stats, err := store.CompressionStats(ctx)
+	fatalIfErr(t, err)
+	if stats.Blocks != 5 || stats.CompressedBlocks != 1 {
+		t.Errorf("unexpected block stats %+v", stats)
+	}
+	if stats.Saved() != int64(len(text.RawData())-stored) {
+		t.Errorf("expected %v bytes saved, got %v", len(text.RawData())-stored, stats.Saved())
+	}
+
+	_, err = plain.Decrement(ctx, file.Cid())
+	fatalIfErr(t, err)
+	_, err = store.Decrement(ctx, cids[0])
+	fatalIfErr(t, err)
+	checkFullStoreByIterator(t, ctx, nil, store)
+	stats, err = store.CompressionStats(ctx)
+	fatalIfErr(t, err)
+	if stats != (CompressionStats{}) {
+		t.Errorf("expected empty stats, got %+v", stats)
+	}
+}
+
+func TestZstd(t *testing.T) {
+	t.Parallel()
+
+	text, err := merkledag.NewRawNodeWPrefix(bytes.Repeat([]byte("Hello World! "), 100), cidBuilder)
+	fatalIfErr(t, err)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	store, err := NewCountedStore(db, &DatabaseOptions{Compression: Zstd})
+	fatalIfErr(t, err)
+	_, err = store.Increment(ctx, text.Cid(), blockGetterFromBlocks(text))
+	fatalIfErr(t, err)
+	value, err := db.Get(store.getDataKey(text.Cid()))
+	fatalIfErr(t, err)
+	if len(value) >= len(text.RawData()) || value[1] != Zstd.ID() {
+		t.Fatalf("expected a zstd compressed value, got %v bytes with compression %v", len(value), value[1])
+	}
+	//zstd values are read by stores with any compression
+	snappyStore, err := NewCountedStore(db, &DatabaseOptions{Compression: Snappy})
+	fatalIfErr(t, err)
+	for _, s := range []*Counted{store, snappyStore} {
+		data, err := s.GetBlock(ctx, text.Cid())
+		fatalIfErr(t, err)
+		if !bytes.Equal(data, text.RawData()) {
+			t.Error("unexpected data of a zstd compressed block")
+		}
+	}
+}
+
+func TestCompressionFsck(t *testing.T) {
+	t.Parallel()
+
+	text, err := merkledag.NewRawNodeWPrefix(bytes.Repeat([]byte("Hello World! "), 400), cidBuilder)
+	fatalIfErr(t, err)
+	file, err := createFile(text)
+	fatalIfErr(t, err)
+	legacy, err := merkledag.NewRawNodeWPrefix(bytes.Repeat([]byte("Hello again! "), 400), cidBuilder)
+	fatalIfErr(t, err)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	//a store not migrated to data headers yet, new data is written with one
+	fatalIfErr(t, db.Put(schemaKey, schema{Version: 1}.encode()))
+	store, err := NewTagCountedStore(db, &DatabaseOptions{Compression: Snappy})
+	fatalIfErr(t, err)
+	getter := blockGetterFromBlocks(text, file, legacy)
+	fatalIfErr(t, store.PutTag(ctx, file.Cid(), datastore.NewKey("A"), getter))
+	fatalIfErr(t, store.PutTag(ctx, legacy.Cid(), datastore.NewKey("B"), getter))
+	compressed, err := Snappy.Compress(legacy.RawData())
+	fatalIfErr(t, err)
+	fatalIfErr(t, store.setData(db, legacy.Cid(), append([]byte{Snappy.ID()}, compressed...)))
+
+	//the stored encoding is found from the value when the counter is lost
+	for _, id := range []cid.Cid{text.Cid(), legacy.Cid()} {
+		fatalIfErr(t, db.Put(datastore.Key(store.getCounterKey(id)), []byte{0}))
+	}
+	report, err := store.Fsck(ctx, true)
+	fatalIfErr(t, err)
+	if report.Repaired != 2 {
+		t.Fatalf("expected 2 repairs, got %+v", report)
+	}
+	for _, b := range []blocks.Block{text, legacy} {
+		data, err := store.GetBlock(ctx, b.Cid())
+		fatalIfErr(t, err)
+		if !bytes.Equal(data, b.RawData()) {
+			t.Errorf("unexpected data of %v after repair", b.Cid())
+		}
+		size, err := store.GetBlockSize(ctx, b.Cid())
+		fatalIfErr(t, err)
+		if size != len(b.RawData()) {
+			t.Errorf("expected size %v, got %v", len(b.RawData()), size)
+		}
+	}
+	checkFsckClean(t, ctx, store)
+}
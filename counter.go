@@ -17,21 +17,70 @@ package sharedforeststore
 import (
 	"context"
 	"io"
-	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/go-metrics-interface"
 	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 type DatabaseOptions struct {
 	LinkDecoder LinkDecoderFunc
+	//Hooks are called after changes are committed, if not nil.
+	Hooks Hooks
+	//ChangeLog enables writing every change to a persisted log in the same transaction,
+	// see Counted.Changes.
+	//Sequence numbers have no gaps, so all transactions with changes update the same sequence record
+	// and conflicting ones are serialized by RetryPolicy.
+	ChangeLog bool
+	//SkipHashVerification disables checking that blocks from BlockGetter match their cid.
+	//It should only be set if all BlockGetters are trusted.
+	SkipHashVerification bool
+	//IngestLimits limits the blocks fetched from BlockGetter by each put.
+	IngestLimits IngestLimits
+	//UnknownCodecPolicy decides how blocks with codecs not supported by LinkDecoder are stored.
+	UnknownCodecPolicy CodecPolicy
+	//RetryPolicy limits the retries of conflicting commits, DefaultRetryPolicy is used if it is nil.
+	//ExponentialBackoff{} retries immediately until success or context cancellation.
+	RetryPolicy RetryPolicy
+	//Compression compresses newly stored block data if not nil, see Snappy and Zstd.
+	//Blocks already stored keep their encoding.
+	Compression Compressor
+	//Decompressors read blocks stored with other compressors than Compression, Snappy and Zstd.
+	Decompressors []Compressor
+	//Keyring encrypts newly stored block data, hashed tag names and the change log if not nil.
+	//Values written before it was set or with older keys are re-encrypted by Counted.Reencrypt.
+	Keyring Keyring
+	//KeyLayout decides how blocks are keyed, it must not change for an existing store
+	// without Counted.MigrateToMultihash.
+	KeyLayout KeyLayout
+	//KeyEncoding decides how cids are encoded in keys, it must not change for an existing store
+	// without Counted.MigrateKeyEncoding.
+	KeyEncoding KeyEncoding
+	//TagHashKey is the key of an HMAC that replaces tag names in tag keys if not nil,
+	// the tag names are kept in the values and encrypted if Keyring is set.
+	TagHashKey []byte
+	//MetricsScope prefixes the names of the go-metrics-interface metrics of the store,
+	// DefaultMetricsScope is used if empty.
+	MetricsScope string
+	//Logger receives the decisions of the store if not nil, a go-log logger can be passed with Desugar.
+	Logger *zap.Logger
+	//LogLevel raises the minimum level of Logger if not nil, for example to zapcore.WarnLevel.
+	LogLevel zapcore.LevelEnabler
 }
 
 type Counted struct {
-	opt DatabaseOptions
-	ds  datastore.TxnDatastore
+	opt     DatabaseOptions
+	ds      datastore.TxnDatastore
+	keys    keyEncoding
+	stats   *txStats
+	metrics *storeMetrics
+	log     *zap.Logger
 }
 
 var _ CounterStore = (*Counted)(nil)
@@ -40,19 +89,46 @@ var _ CounterStore = (*Counted)(nil)
 type Tx struct {
 	context.Context
 	transaction datastore.Txn
+	store       *Counted
+	events      []Change
+	lastSeq     uint64 //last change log sequence number, 0 if not loaded
+	ingest      ingestState
+	changed     txMetrics
+	depth       int //recursion depth of increment and decrement, for tracing
+	pending     []pendingLog
 }
 
 //NewCountedStore creates a new Counted (implements CounterStore) from a transactional datastore.
-func NewCountedStore(ds datastore.TxnDatastore, opt *DatabaseOptions) *Counted {
+//It fails if the store was written by a newer schema version or with another KeyLayout,
+// older schema versions are upgraded by Counted.Migrate while the store is in use.
+//It fails with ErrMigrationInProgress while an interrupted Counted.MigrateToMultihash or
+// Counted.MigrateKeyEncoding is pending, see MigrateStore.
+func NewCountedStore(ds datastore.TxnDatastore, opt *DatabaseOptions) (*Counted, error) {
+	c := newCounted(ds, opt)
+	if err := c.checkSchema(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//newCounted creates a Counted without checking the schema of the store.
+func newCounted(ds datastore.TxnDatastore, opt *DatabaseOptions) *Counted {
 	if opt == nil {
 		opt = &DatabaseOptions{}
 	}
 	if opt.LinkDecoder == nil {
 		opt.LinkDecoder = LinkDecoder
 	}
+	if opt.RetryPolicy == nil {
+		opt.RetryPolicy = DefaultRetryPolicy
+	}
 	return &Counted{
-		opt: *opt,
-		ds:  ds,
+		opt:     *opt,
+		ds:      ds,
+		keys:    newKeyEncoding(opt.KeyEncoding),
+		stats:   &txStats{},
+		metrics: newStoreMetrics(opt.MetricsScope, metrics.New),
+		log:     newLogger(opt.Logger, opt.LogLevel),
 	}
 }
 
@@ -67,6 +143,8 @@ func (c *Counted) newTransaction(ctx context.Context) (*Tx, error) {
 	return &Tx{
 		Context:     ctx,
 		transaction: tx,
+		store:       c,
+		ingest:      ingestState{limits: c.opt.IngestLimits},
 	}, err
 }
 
@@ -78,81 +156,189 @@ func (c *Counted) txWarp(ctx context.Context, f func(tx *Tx) error) error {
 	}
 	defer tx.transaction.Discard()
 	var commitError error
-	for {
-		if err := f(tx); err != nil {
+	for failures := 1; ; failures++ {
+		err, commitErr := tx.attempt(ctx, f, failures-1)
+		if err != nil {
 			return multierr.Combine(err, commitError)
 		}
-		if commitError = tx.transaction.Commit(); commitError == nil {
+		if commitError = commitErr; commitError == nil {
+			atomic.AddUint64(&c.stats.commits, 1)
+			tx.observeCommit()
+			tx.writeLogs()
+			tx.fireHooks()
 			return nil
 		}
+		atomic.AddUint64(&c.stats.conflicts, 1)
+		c.metrics.conflicts.Inc()
+		if ce := c.log.Check(zap.DebugLevel, "commit conflict"); ce != nil {
+			ce.Write(zap.Int("attempt", failures), zap.Error(commitError))
+		}
+		if err := c.backoff(ctx, failures, commitError); err != nil {
+			return err
+		}
 		if err := tx.reset(c.ds); err != nil {
 			return multierr.Combine(err, commitError)
 		}
 	}
 }
 
+//setCount sets the counter of a cid and records the change
+func (c *Tx) setCount(id cid.Cid, key counterKey, count int64, meta metadata) error {
+	if err := setCount(c.transaction, key, count, meta); err != nil {
+		return err
+	}
+	return c.record(Change{Kind: ChangeCount, Cid: id, Count: count})
+}
+
+//Update runs f in a single transaction, so all actions in f are committed atomically.
+//If the commit failed, f is called again on a new transaction according to the RetryPolicy,
+// so f should not have side effects outside of the transaction.
+//The transaction is discarded if f returns an error. Tx must not be used after f returns.
+func (c *Counted) Update(ctx context.Context, f func(tx *Tx) error) error {
+	return c.txWarp(ctx, f)
+}
+
 func (c *Tx) reset(db datastore.TxnDatastore) (err error) {
 	if err := c.Err(); err != nil {
 		return err
 	}
 	c.transaction.Discard()
+	c.events = c.events[:0]
+	c.lastSeq = 0
+	c.changed = txMetrics{}
+	c.pending = c.pending[:0]
+	c.ingest = ingestState{limits: c.store.opt.IngestLimits}
 	c.transaction, err = db.NewTransaction(false)
 	return err
 }
 
 func (c *Counted) Increment(ctx context.Context, id cid.Cid, bg BlockGetter) (count int64, err error) {
+	defer observeSince(c.metrics.increment, time.Now())
 	err = c.txWarp(ctx, func(tx *Tx) error {
-		count, err = tx.increment(id, bg, c.opt.LinkDecoder)
+		count, err = tx.Increment(id, bg)
 		return err
 	})
 	return
 }
 
-func (c *Tx) increment(id cid.Cid, bg BlockGetter, ld LinkDecoderFunc) (int64, error) {
+//Increment is Counted.Increment as part of the transaction.
+func (c *Tx) Increment(id cid.Cid, bg BlockGetter) (int64, error) {
+	return c.increment(id, bg)
+}
+
+func (c *Tx) increment(id cid.Cid, bg BlockGetter) (count int64, err error) {
 	if err := c.Err(); err != nil {
 		return 0, err
 	}
-	count, meta, key, err := getCount(c.transaction, id)
+	span := c.startSpan("increment", id)
+	defer func() {
+		span.finish(err)
+	}()
+	id = c.store.normalize(id)
+	if isIdentity(id) {
+		return c.countIdentity(id, 1, func(link cid.Cid) error {
+			_, err := c.increment(link, bg)
+			return err
+		})
+	}
+	count, meta, key, err := c.store.getCount(c.transaction, id)
 	if err != nil {
 		return 0, err
 	}
 	count++
-	if err := setCount(c.transaction, key, count, metadata{Complete: true}); err != nil {
+	next := metadata{Complete: true, HavePart: true}.withBlock(meta)
+	if err := c.setCount(id, key, count, next); err != nil {
 		return 0, err
 	}
 	if count > 1 && meta.Complete {
+		if ce := c.store.log.Check(zap.DebugLevel, "block already stored, links not followed"); ce != nil {
+			ce.Write(cidField(id), zap.Int64("count", count), zap.Int("depth", c.depth))
+		}
 		return count, nil
 	}
-	var data []byte
-	if !meta.HavePart {
-		data, err = bg.GetBlock(c, id)
-		if err != nil {
-			return 0, err
-		}
-		err = setData(c.transaction, id, data)
-	} else {
-		data, err = c.transaction.Get(getDataKey(id))
+	if ce := c.store.log.Check(zap.DebugLevel, "following links"); ce != nil {
+		ce.Write(cidField(id), zap.Int64("count", count), zap.Int("depth", c.depth), zap.Bool("stored", meta.HavePart))
 	}
-	if err != nil {
-		return 0, err
+	var cids []cid.Cid
+	if meta.HavePart {
+		cids, _, err = c.store.storedLinks(c.transaction, id)
+	} else {
+		var stored metadata
+		if cids, _, stored, err = c.storeBlock(id, bg); err == nil {
+			//the size is only known once the block is stored
+			err = setCount(c.transaction, key, count, next.withBlock(stored))
+		}
 	}
-	cids, _, err := ld(id, data)
 	if err != nil {
 		return 0, err
 	}
 	for _, linkedCid := range cids {
-		if _, err := c.increment(linkedCid, bg, ld); err != nil {
+		if _, err := c.increment(linkedCid, bg); err != nil {
 			return 0, err
 		}
 	}
 	return count, nil
 }
 
+//storeBlock fetches and saves a new block, it returns the links and logical size of the block,
+// and the stored block fields to save in its counter.
+//The IngestLimits are checked before anything is written, so a progressive put can be undone
+// in the transaction that exceeded them.
+func (c *Tx) storeBlock(id cid.Cid, bg BlockGetter) ([]cid.Cid, uint64, metadata, error) {
+	data, stored, shared, err := c.store.sharedData(c.transaction, id)
+	if err != nil {
+		return nil, 0, metadata{}, err
+	}
+	if !shared {
+		if data, err = c.store.fetchBlock(c, bg, id); err != nil {
+			return nil, 0, metadata{}, err
+		}
+		if err := c.ingest.addBlock(id, data); err != nil {
+			return nil, 0, metadata{}, err
+		}
+	}
+	cids, size, marker, err := c.store.decodeNew(id, data)
+	if err != nil {
+		if ce := c.store.log.Check(zap.WarnLevel, "failed to decode links"); ce != nil {
+			ce.Write(cidField(id), zap.Error(err))
+		}
+		return nil, 0, metadata{}, err
+	}
+	if err := c.ingest.checkLinks(id, cids); err != nil {
+		return nil, 0, metadata{}, err
+	}
+	if shared {
+		err = c.shareData(id)
+	} else {
+		stored, err = c.putData(id, data)
+		c.changed.storedBytes += uint64(len(data))
+	}
+	if err != nil {
+		return nil, 0, metadata{}, err
+	}
+	if err := c.record(Change{Kind: ChangeBlockStored, Cid: id}); err != nil {
+		return nil, 0, metadata{}, err
+	}
+	return cids, size, stored, c.saveDecoded(id, cids, size, marker)
+}
+
 func (c *Counted) GetCount(ctx context.Context, id cid.Cid) (count int64, err error) {
 	if err := ctx.Err(); err != nil {
 		return 0, err
 	}
-	count, meta, _, err := getCount(c.ds, id)
+	count, meta, _, err := c.getCount(c.ds, c.normalize(id))
+	if !meta.Complete {
+		return 0, err
+	}
+	return count, err
+}
+
+//GetCount is Counted.GetCount as part of the transaction.
+func (c *Tx) GetCount(id cid.Cid) (int64, error) {
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+	count, meta, _, err := c.store.getCount(c.transaction, c.store.normalize(id))
 	if !meta.Complete {
 		return 0, err
 	}
@@ -160,18 +346,35 @@ func (c *Counted) GetCount(ctx context.Context, id cid.Cid) (count int64, err er
 }
 
 func (c *Counted) Decrement(ctx context.Context, id cid.Cid) (count int64, err error) {
+	defer observeSince(c.metrics.decrement, time.Now())
 	err = c.txWarp(ctx, func(tx *Tx) error {
-		count, err = tx.decrement(id, c.opt.LinkDecoder)
+		count, err = tx.Decrement(id)
 		return err
 	})
 	return
 }
 
-func (c *Tx) decrement(id cid.Cid, ld LinkDecoderFunc) (int64, error) {
+//Decrement is Counted.Decrement as part of the transaction.
+func (c *Tx) Decrement(id cid.Cid) (int64, error) {
+	return c.decrement(id)
+}
+
+func (c *Tx) decrement(id cid.Cid) (count int64, err error) {
 	if err := c.Err(); err != nil {
 		return 0, err
 	}
-	count, meta, key, err := getCount(c.transaction, id)
+	span := c.startSpan("decrement", id)
+	defer func() {
+		span.finish(err)
+	}()
+	id = c.store.normalize(id)
+	if isIdentity(id) {
+		return c.countIdentity(id, -1, func(link cid.Cid) error {
+			_, err := c.decrement(link)
+			return err
+		})
+	}
+	count, meta, key, err := c.store.getCount(c.transaction, id)
 	if err != nil {
 		return 0, err
 	}
@@ -179,25 +382,33 @@ func (c *Tx) decrement(id cid.Cid, ld LinkDecoderFunc) (int64, error) {
 	if count < 0 {
 		return count, nil
 	}
-	if err := setCount(c.transaction, key, count, meta); err != nil {
+	if err := c.setCount(id, key, count, meta); err != nil {
 		return 0, err
 	}
 	if !meta.HavePart {
 		return 0, nil
 	}
 	if count > 0 {
+		if ce := c.store.log.Check(zap.DebugLevel, "block still referenced, links kept"); ce != nil {
+			ce.Write(cidField(id), zap.Int64("count", count), zap.Int("depth", c.depth))
+		}
 		return count, nil
 	}
-	data, err := deleteData(c.transaction, id)
+	cids, _, err := c.store.storedLinks(c.transaction, id)
 	if err != nil {
 		return 0, err
 	}
-	cids, _, err := ld(id, data)
-	if err != nil {
+	if err := c.store.deleteBlock(c.transaction, id); err != nil {
 		return 0, err
 	}
+	if err := c.record(Change{Kind: ChangeBlockDeleted, Cid: id}); err != nil {
+		return 0, err
+	}
+	if c.store.logs(zap.InfoLevel) {
+		c.logOnCommit(zap.InfoLevel, "block deleted", cidField(id), zap.Int("depth", c.depth))
+	}
 	for _, linkedCid := range cids {
-		if _, err := c.decrement(linkedCid, ld); err != nil {
+		if _, err := c.decrement(linkedCid); err != nil {
 			return 0, err
 		}
 	}
@@ -208,19 +419,40 @@ func (c *Counted) GetBlock(ctx context.Context, id cid.Cid) ([]byte, error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	return c.ds.Get(getDataKey(id))
+	if isIdentity(id) {
+		return identityData(id)
+	}
+	return c.getData(c.ds, id)
 }
 
+//GetBlockSize returns the size of a stored block from its counter,
+// datastore.ErrNotFound is returned if the block is not stored.
 func (c *Counted) GetBlockSize(ctx context.Context, id cid.Cid) (int, error) {
 	if err := ctx.Err(); err != nil {
 		return 0, err
 	}
-	return c.ds.GetSize(getDataKey(id))
+	if isIdentity(id) {
+		data, err := identityData(id)
+		return len(data), err
+	}
+	_, meta, _, err := c.getBlockMeta(c.ds, c.normalize(id))
+	if err != nil {
+		return 0, err
+	}
+	if !meta.HavePart {
+		return -1, datastore.ErrNotFound
+	}
+	if !meta.SizeKnown {
+		return c.ds.GetSize(c.dataKey(id)) //counter not migrated yet
+	}
+	return int(meta.Size), nil
 }
 
 type ckiter struct {
-	rs  query.Results
-	err error
+	store  *Counted
+	rs     query.Results
+	err    error
+	suffix datastore.Key //keys of stored cids, see Counted.storedSuffix
 }
 
 func (c *ckiter) NextCid() (cid.Cid, error) {
@@ -237,14 +469,11 @@ func (c *ckiter) NextCid() (cid.Cid, error) {
 			return cid.Undef, c.err
 		}
 	}
-	return dataKeyToCid(r.Key) //should never error here since that is filtered
+	return c.store.keyToCid(r.Key, c.suffix) //should never error here since that is filtered
 }
 
 func (c *ckiter) Filter(e query.Entry) bool {
-	if !strings.HasSuffix(e.Key, dataSuffixKey.String()) {
-		return false
-	}
-	_, err := dataKeyToCid(e.Key)
+	_, err := c.store.keyToCid(e.Key, c.suffix)
 	return err == nil
 }
 
@@ -256,7 +485,7 @@ func (c *ckiter) Close() error {
 }
 
 func (c *Counted) KeysIterator(prefix string) CidIterator {
-	it := &ckiter{}
+	it := &ckiter{store: c, suffix: c.storedSuffix()}
 	it.rs, it.err = c.ds.Query(query.Query{
 		Filters:  []query.Filter{it},
 		KeysOnly: true,
@@ -21,6 +21,7 @@ import (
 
 	"github.com/ipfs/go-cid"
 	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/pkg/errors"
 )
 
 func TestCounter(t *testing.T) {
@@ -40,7 +41,8 @@ func TestCounter(t *testing.T) {
 	cids, getter := setup(t)
 	db, err := leveldb.NewDatastore("", nil)
 	fatalIfErr(t, err)
-	store := NewCountedStore(db, nil)
+	store, err := NewCountedStore(db, nil)
+	fatalIfErr(t, err)
 	ctx := context.Background()
 
 	for _, c := range cases {
@@ -63,6 +65,50 @@ func TestCounter(t *testing.T) {
 	}
 }
 
+func TestUpdate(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	store, err := NewCountedStore(db, nil)
+	fatalIfErr(t, err)
+	ctx := context.Background()
+
+	_, err = store.Increment(ctx, cids[0], getter)
+	fatalIfErr(t, err)
+	//move the count from A to C in one transaction
+	fatalIfErr(t, store.Update(ctx, func(tx *Tx) error {
+		if _, err := tx.Increment(cids[2], getter); err != nil {
+			return err
+		}
+		count, err := tx.GetCount(cids[5])
+		if err != nil {
+			return err
+		}
+		if count != 3 {
+			t.Errorf("expected count 3 in transaction, got %v", count)
+		}
+		_, err = tx.Decrement(cids[0])
+		return err
+	}))
+	checkCounts(t, ctx, []int64{0, 0, 1, 0, 1, 2}, cids, store)
+
+	//nothing is committed if the transaction failed
+	errTest := errors.New("test")
+	err = store.Update(ctx, func(tx *Tx) error {
+		if _, err := tx.Increment(cids[1], getter); err != nil {
+			return err
+		}
+		return errTest
+	})
+	if err != errTest {
+		t.Fatalf("expected %v, got %v", errTest, err)
+	}
+	checkCounts(t, ctx, []int64{0, 0, 1, 0, 1, 2}, cids, store)
+}
+
 func checkCounts(t testing.TB, ctx context.Context, exp []int64, cids []cid.Cid, store CounterStore) {
 	for i, expCount := range exp {
 		gotCount, err := store.GetCount(ctx, cids[i])
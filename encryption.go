@@ -0,0 +1,403 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/pkg/errors"
+)
+
+//Keyring provides the keys for encryption at rest.
+type Keyring interface {
+	//Current returns the ID and AEAD of the key that encrypts new values.
+	Current() (uint32, cipher.AEAD)
+	//Key returns the AEAD of a key ID to decrypt values, or KeyNotFoundError.
+	Key(id uint32) (cipher.AEAD, error)
+}
+
+//KeyNotFoundError is returned for values encrypted with a key missing from the Keyring.
+type KeyNotFoundError struct {
+	ID uint32
+}
+
+func (e *KeyNotFoundError) Error() string {
+	return fmt.Sprintf("encryption key %v not found", e.ID)
+}
+
+//AESKeyring is a Keyring of AES-GCM keys, it is safe for concurrent use.
+type AESKeyring struct {
+	lock    sync.RWMutex
+	current uint32
+	keys    map[uint32]cipher.AEAD
+}
+
+//NewAESKeyring creates an AESKeyring with a current key of 16, 24 or 32 bytes.
+func NewAESKeyring(id uint32, key []byte) (*AESKeyring, error) {
+	k := &AESKeyring{keys: make(map[uint32]cipher.AEAD)}
+	if err := k.Add(id, key); err != nil {
+		return nil, err
+	}
+	k.current = id
+	return k, nil
+}
+
+//Add adds a key for decryption, or replaces the key of the same ID.
+func (k *AESKeyring) Add(id uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys[id] = aead
+	return nil
+}
+
+//SetCurrent sets the key that encrypts new values, existing values are re-encrypted by Counted.Reencrypt.
+func (k *AESKeyring) SetCurrent(id uint32) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return &KeyNotFoundError{ID: id}
+	}
+	k.current = id
+	return nil
+}
+
+func (k *AESKeyring) Current() (uint32, cipher.AEAD) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.current, k.keys[k.current]
+}
+
+func (k *AESKeyring) Key(id uint32) (cipher.AEAD, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, &KeyNotFoundError{ID: id}
+	}
+	return aead, nil
+}
+
+//seal encrypts a value with the current key as: varint key ID, nonce, then the ciphertext.
+//The additional data binds the value to its key, so values can not be swapped.
+func (c *Counted) seal(value, ad []byte) ([]byte, error) {
+	id, aead := c.opt.Keyring.Current()
+	buf := make([]byte, binary.MaxVarintLen32, binary.MaxVarintLen32+aead.NonceSize()+len(value)+aead.Overhead())
+	buf = buf[:binary.PutUvarint(buf, uint64(id))]
+	nonce := buf[len(buf) : len(buf)+aead.NonceSize()]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return aead.Seal(buf[:len(buf)+len(nonce)], nonce, value, ad), nil
+}
+
+//open decrypts a sealed value, it also returns the ID of the key that was used.
+func (c *Counted) open(sealed, ad []byte) ([]byte, uint32, error) {
+	if c.opt.Keyring == nil {
+		return nil, 0, errors.New("value is encrypted but no Keyring is set")
+	}
+	id, n, err := sealedKeyID(sealed)
+	if err != nil {
+		return nil, 0, err
+	}
+	aead, err := c.opt.Keyring.Key(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	sealed = sealed[n:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, 0, errors.New("encrypted value is truncated")
+	}
+	value, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	return value, id, nil
+}
+
+//sealedKeyID returns the key ID in the header of a sealed value and the header length.
+func sealedKeyID(sealed []byte) (uint32, int, error) {
+	id, n := binary.Uvarint(sealed)
+	if n <= 0 || id > 1<<32-1 {
+		return 0, 0, errors.Errorf("corrupted encryption header, from raw `%x`", sealed)
+	}
+	return uint32(id), n, nil
+}
+
+//sealedMarker is the first byte of marked values that are sealed.
+//It is used where the value has no other metadata, and is never the first byte of a plaintext value.
+const sealedMarker = 0xff
+
+//sealMarked seals a value with sealedMarker if a Keyring is set, or returns it as is.
+func (c *Counted) sealMarked(value, ad []byte) ([]byte, error) {
+	if c.opt.Keyring == nil {
+		return value, nil
+	}
+	sealed, err := c.seal(value, ad)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{sealedMarker}, sealed...), nil
+}
+
+//openMarked opens a value written by sealMarked.
+func (c *Counted) openMarked(value, ad []byte) ([]byte, error) {
+	if len(value) == 0 || value[0] != sealedMarker {
+		return value, nil
+	}
+	plain, _, err := c.open(value[1:], ad)
+	return plain, err
+}
+
+var tagHashEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//tagKey returns the key to write a tag to.
+//If TagHashKey is set, the key has a keyed hash of the tag and the tag is in the value.
+func (c *Counted) tagKey(id cid.Cid, tag datastore.Key) datastore.Key {
+	if c.opt.TagHashKey == nil {
+		return c.getTagKey(id, tag)
+	}
+	mac := hmac.New(sha256.New, c.opt.TagHashKey)
+	mac.Write(tag.Bytes())
+	return c.getHashedTagKey(id, "/"+tagHashEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+//tagValue returns the value to write to a tag key.
+func (c *Counted) tagValue(key, tag datastore.Key) ([]byte, error) {
+	if c.opt.TagHashKey == nil {
+		return nil, nil
+	}
+	return c.sealMarked(tag.Bytes(), key.Bytes())
+}
+
+//findTag returns the key of a tag if it exists.
+//Tags put before TagHashKey was set are found by their plain key until Reencrypt moves them.
+func (c *Counted) findTag(db datastore.Read, id cid.Cid, tag datastore.Key) (datastore.Key, bool, error) {
+	id = c.normalize(id)
+	key := c.tagKey(id, tag)
+	has, err := db.Has(key)
+	if has || err != nil || c.opt.TagHashKey == nil {
+		return key, has, err
+	}
+	key = c.getTagKey(id, tag)
+	has, err = db.Has(key)
+	return key, has, err
+}
+
+//decodeTag returns the cid and tag of a plain or hashed tag entry.
+func (c *Counted) decodeTag(key string, value []byte) (cid.Cid, datastore.Key, error) {
+	if id, tag, err := c.tagKeyToCid(key); err == nil {
+		return id, tag, nil
+	}
+	id, err := c.hashedTagKeyToCid(key)
+	if err != nil {
+		return cid.Undef, datastore.Key{}, err
+	}
+	tag, err := c.openMarked(value, datastore.RawKey(key).Bytes())
+	if err != nil {
+		return cid.Undef, datastore.Key{}, err
+	}
+	return id, datastore.RawKey(string(tag)), nil
+}
+
+//tagKeyCid returns the cid of a plain or hashed tag key
+func (c *Counted) tagKeyCid(key string) (cid.Cid, error) {
+	if id, _, err := c.tagKeyToCid(key); err == nil {
+		return id, nil
+	}
+	return c.hashedTagKeyToCid(key)
+}
+
+//ReencryptReport counts the values rewritten by Reencrypt.
+type ReencryptReport struct {
+	Blocks  int
+	Tags    int
+	Changes int
+}
+
+//Reencrypt rewrites block data, tag values and changes that are not encrypted with the current key
+// of the Keyring, and moves tags put before TagHashKey was set to their hashed keys.
+//It works in small transactions, so it can run in the background of a live store and continues
+// where it left off if run again. Older keys can be removed from the Keyring once it returns.
+func (c *Counted) Reencrypt(ctx context.Context) (ReencryptReport, error) {
+	var report ReencryptReport
+	rs, err := c.ds.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		return report, err
+	}
+	es, err := rs.Rest()
+	if err != nil {
+		return report, err
+	}
+	for len(es) > 0 {
+		batch := es
+		if len(batch) > migrateBatchSize {
+			batch = batch[:migrateBatchSize]
+		}
+		es = es[len(batch):]
+		var r ReencryptReport
+		if err := c.txWarp(ctx, func(tx *Tx) error {
+			r = ReencryptReport{}
+			for _, e := range batch {
+				if err := tx.reencrypt(e.Key, &r); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return report, err
+		}
+		report.Blocks += r.Blocks
+		report.Tags += r.Tags
+		report.Changes += r.Changes
+	}
+	return report, nil
+}
+
+//needsSeal returns true if a value should be sealed with the current key
+func (c *Counted) needsSeal(sealed []byte, isSealed bool) (bool, error) {
+	if c.opt.Keyring == nil {
+		return false, nil
+	}
+	if !isSealed {
+		return true, nil
+	}
+	id, _, err := sealedKeyID(sealed)
+	if err != nil {
+		return false, err
+	}
+	current, _ := c.opt.Keyring.Current()
+	return id != current, nil
+}
+
+func (c *Tx) reencrypt(key string, r *ReencryptReport) error {
+	if id, err := c.store.keyToCid(key, dataSuffixKey); err == nil {
+		changed, err := c.reencryptData(id)
+		if changed {
+			r.Blocks++
+		}
+		return err
+	}
+	if strings.HasPrefix(key, changeLogKey.String()+"/") {
+		changed, err := c.resealMarked(datastore.RawKey(key))
+		if changed {
+			r.Changes++
+		}
+		return err
+	}
+	if id, tag, err := c.store.tagKeyToCid(key); err == nil {
+		if c.store.opt.TagHashKey == nil {
+			return nil
+		}
+		//move the tag to its hashed key
+		hashed := c.store.tagKey(id, tag)
+		value, err := c.store.tagValue(hashed, tag)
+		if err != nil {
+			return err
+		}
+		if err := c.transaction.Put(hashed, value); err != nil {
+			return err
+		}
+		r.Tags++
+		return c.transaction.Delete(datastore.RawKey(key))
+	}
+	if _, err := c.store.hashedTagKeyToCid(key); err == nil {
+		changed, err := c.resealMarked(datastore.RawKey(key))
+		if changed {
+			r.Tags++
+		}
+		return err
+	}
+	return nil
+}
+
+//reencryptData seals the data of a block with the current key
+func (c *Tx) reencryptData(id cid.Cid) (bool, error) {
+	count, meta, key, err := c.store.getBlockMeta(c.transaction, id)
+	if count == 0 || err != nil {
+		return false, err
+	}
+	value, err := c.transaction.Get(c.store.dataKey(id))
+	if err == datastore.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if ok, err := c.store.needsSeal(sealedData(value, meta)); !ok || err != nil {
+		return false, err
+	}
+	//the data is written again with a data header, counters of the first format version have uncompressed data
+	data, err := c.store.decodeData(c.store.dataKey(id), value, meta)
+	if err != nil {
+		return false, err
+	}
+	value, stored, err := c.store.encodeData(c.store.dataKey(id), data)
+	if err != nil {
+		return false, err
+	}
+	if err := c.transaction.Put(c.store.dataKey(id), value); err != nil {
+		return false, err
+	}
+	return true, setCount(c.transaction, key, count, meta.withBlock(stored))
+}
+
+//resealMarked seals a value written by sealMarked with the current key
+func (c *Tx) resealMarked(key datastore.Key) (bool, error) {
+	value, err := c.transaction.Get(key)
+	if err == datastore.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	isSealed := len(value) > 0 && value[0] == sealedMarker
+	if isSealed {
+		value = value[1:]
+	}
+	if ok, err := c.store.needsSeal(value, isSealed); !ok || err != nil {
+		return false, err
+	}
+	if isSealed {
+		if value, _, err = c.store.open(value, key.Bytes()); err != nil {
+			return false, err
+		}
+	}
+	if value, err = c.store.sealMarked(value, key.Bytes()); err != nil {
+		return false, err
+	}
+	return true, c.transaction.Put(key, value)
+}
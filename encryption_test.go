@@ -0,0 +1,163 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/pkg/errors"
+)
+
+func TestEncryption(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	tagA, tagB := datastore.NewKey("tagA"), datastore.NewKey("tagB")
+
+	plain, err := NewTagCountedStore(db, &DatabaseOptions{ChangeLog: true})
+	fatalIfErr(t, err)
+	fatalIfErr(t, plain.PutTag(ctx, cids[0], tagA, getter))
+
+	keys, err := NewAESKeyring(1, bytes.Repeat([]byte{1}, 32))
+	fatalIfErr(t, err)
+	opt := &DatabaseOptions{ChangeLog: true, Keyring: keys, TagHashKey: []byte("secret")}
+	store, err := NewTagCountedStore(db, opt)
+	fatalIfErr(t, err)
+	has, err := store.HasTag(ctx, cids[0], tagA)
+	fatalIfErr(t, err)
+	if !has {
+		t.Fatal("expected tag put before encryption to be found")
+	}
+	fatalIfErr(t, store.PutTag(ctx, cids[1], tagB, getter))
+	fatalIfErr(t, store.PutTag(ctx, cids[0], tagA, getter)) //no-op
+	checkCounts(t, ctx, []int64{1, 1, 0, 2, 1, 3}, cids, store)
+	checkTags(t, ctx, cids[1], []string{tagB.String()}, store)
+
+	//new data and tag names are not stored in plain text
+	e := cids[4]
+	data, err := getter.GetBlock(ctx, e)
+	fatalIfErr(t, err)
+	raw, err := db.Get(store.getDataKey(e))
+	fatalIfErr(t, err)
+	if bytes.Contains(raw, data) {
+		t.Error("expected block data to be encrypted")
+	}
+	checkRaw := func(plainTagA bool) {
+		t.Helper()
+		rs, err := db.Query(query.Query{})
+		fatalIfErr(t, err)
+		es, err := rs.Rest()
+		fatalIfErr(t, err)
+		for _, e := range es {
+			hasA := strings.Contains(e.Key, "tagA") || bytes.Contains(e.Value, []byte("tagA"))
+			if strings.Contains(e.Key, "tagB") || bytes.Contains(e.Value, []byte("tagB")) || (hasA && !plainTagA) {
+				t.Errorf("found tag name in %v", e.Key)
+			}
+		}
+	}
+	checkRaw(true)
+
+	checkAll := func(store *TagCounted) {
+		t.Helper()
+		for _, id := range cids[:2] {
+			data, err := store.GetBlock(ctx, id)
+			fatalIfErr(t, err)
+			expected, err := getter.GetBlock(ctx, id)
+			fatalIfErr(t, err)
+			if !bytes.Equal(data, expected) {
+				t.Errorf("unexpected data of %v", id)
+			}
+		}
+		it := store.TagsIterator()
+		tags := map[string]bool{}
+		for {
+			_, tag, err := it.NextTag()
+			if err == io.EOF {
+				break
+			}
+			fatalIfErr(t, err)
+			tags[tag.String()] = true
+		}
+		if len(tags) != 2 || !tags[tagA.String()] || !tags[tagB.String()] {
+			t.Errorf("unexpected tags %v", tags)
+		}
+		changes := store.Changes(0)
+		defer changes.Close()
+		for {
+			ch, err := changes.NextChange()
+			if err == io.EOF {
+				break
+			}
+			fatalIfErr(t, err)
+			if ch.Kind == ChangeTagPut && ch.Tag != tagA && ch.Tag != tagB {
+				t.Errorf("unexpected change %v", ch)
+			}
+		}
+		report, err := store.Fsck(ctx, false)
+		fatalIfErr(t, err)
+		if len(report.Issues) != 0 {
+			t.Errorf("unexpected fsck issues %v", report.Issues)
+		}
+	}
+	checkAll(store)
+
+	//rotate to a new key and drop the old one
+	fatalIfErr(t, keys.Add(2, bytes.Repeat([]byte{2}, 16)))
+	fatalIfErr(t, keys.SetCurrent(2))
+	report, err := store.Reencrypt(ctx)
+	fatalIfErr(t, err)
+	if report.Blocks != 5 || report.Tags != 2 || report.Changes == 0 {
+		t.Errorf("unexpected reencrypt report %+v", report)
+	}
+	if report, err = store.Reencrypt(ctx); err != nil || report != (ReencryptReport{}) {
+		t.Errorf("expected nothing left to reencrypt, got %+v, %v", report, err)
+	}
+	checkRaw(false)
+	rotated, err := NewAESKeyring(2, bytes.Repeat([]byte{2}, 16))
+	fatalIfErr(t, err)
+	opt.Keyring = rotated
+	store, err = NewTagCountedStore(db, opt)
+	fatalIfErr(t, err)
+	checkAll(store)
+
+	var notFound *KeyNotFoundError
+	withKeys, err := NewTagCountedStore(db, &DatabaseOptions{Keyring: keys})
+	fatalIfErr(t, err)
+	if _, err := withKeys.GetBlock(ctx, e); err != nil {
+		t.Errorf("expected old keyring with the new key to read, got %v", err)
+	}
+	old, err := NewAESKeyring(1, bytes.Repeat([]byte{1}, 32))
+	fatalIfErr(t, err)
+	withOld, err := NewTagCountedStore(db, &DatabaseOptions{Keyring: old})
+	fatalIfErr(t, err)
+	if _, err := withOld.GetBlock(ctx, e); !errors.As(err, &notFound) {
+		t.Errorf("expected KeyNotFoundError, got %v", err)
+	}
+
+	fatalIfErr(t, store.RemoveTag(ctx, cids[0], tagA))
+	fatalIfErr(t, store.RemoveTag(ctx, cids[1], tagB))
+	checkFullStoreByIterator(t, ctx, nil, store)
+}
@@ -0,0 +1,412 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/pkg/errors"
+)
+
+//FsckCategory is the kind of an inconsistency found by Fsck.
+type FsckCategory uint8
+
+const (
+	//FsckCorruptCounter is a counter that can not be decoded.
+	FsckCorruptCounter FsckCategory = iota + 1
+	//FsckDataWithoutCounter is stored data without a counter.
+	FsckDataWithoutCounter
+	//FsckCounterWithoutData is a counter that claims to have data, but the data is missing.
+	FsckCounterWithoutData
+	//FsckTagWithoutCounter is a tag on a cid without a counter.
+	FsckTagWithoutCounter
+	//FsckCountMismatch is a count below the number of tags plus references from stored parents.
+	FsckCountMismatch
+	//FsckCompleteMismatch is a counter marked complete while some linked data is missing, or the other way around.
+	FsckCompleteMismatch
+	//FsckUndecodableData is stored data that LinkDecoder failed on, so its links are unknown.
+	FsckUndecodableData
+	//FsckDataRefsMismatch is data shared by multihash with a reference count that is not the number
+	// of cids storing it, see LayoutMultihash.
+	FsckDataRefsMismatch
+)
+
+func (c FsckCategory) String() string {
+	switch c {
+	case FsckCorruptCounter:
+		return "CorruptCounter"
+	case FsckDataWithoutCounter:
+		return "DataWithoutCounter"
+	case FsckCounterWithoutData:
+		return "CounterWithoutData"
+	case FsckTagWithoutCounter:
+		return "TagWithoutCounter"
+	case FsckCountMismatch:
+		return "CountMismatch"
+	case FsckCompleteMismatch:
+		return "CompleteMismatch"
+	case FsckUndecodableData:
+		return "UndecodableData"
+	case FsckDataRefsMismatch:
+		return "DataRefsMismatch"
+	default:
+		return "FsckCategory(" + strconv.Itoa(int(c)) + ")"
+	}
+}
+
+//FsckIssue is an inconsistency found by Fsck.
+type FsckIssue struct {
+	Category FsckCategory
+	Cid      cid.Cid
+	Detail   string
+}
+
+func (i FsckIssue) String() string {
+	return fmt.Sprintf("%v %v: %v", i.Category, i.Cid, i.Detail)
+}
+
+//FsckReport lists all inconsistencies found by Fsck.
+type FsckReport struct {
+	Issues []FsckIssue
+	//Repaired is the number of cids rewritten by repair
+	Repaired int
+}
+
+//fsckNode is everything known about a cid during Fsck, link lists are read from the store when needed
+type fsckNode struct {
+	hasCounter bool
+	corrupt    bool
+	count      int64
+	meta       metadata
+	hasData    bool
+	hasLinks   bool
+	identity   bool //data is inline, the counter has no data
+	decoded    bool
+	tags       int64
+	parents    int   //links from stored parents that are not visited yet
+	refs       int64 //tags plus references from live parents and Increment
+	complete   bool
+}
+
+//fsckData is data shared by multihash in LayoutMultihash
+type fsckData struct {
+	stored bool
+	refs   int64
+	views  int64 //cids storing the data, after repair
+}
+
+//Fsck scans the store and reports every inconsistency between counters, tags and data.
+//Counts are expected to be at least the number of tags plus the references from stored parents,
+// a count above that is held by Increment and keeps its DAG like a tag.
+//The scan keeps a small record per cid in memory, link lists are read again when they are needed.
+//If repair is true, counts are recomputed from tags, Increment and the link graph, blocks that are
+// not reachable from any of them are deleted. Repair should not run concurrently with other writes.
+func (c *TagCounted) Fsck(ctx context.Context, repair bool) (*FsckReport, error) {
+	report := &FsckReport{}
+	nodes := make(map[cid.Cid]*fsckNode)
+	node := func(id cid.Cid) *fsckNode {
+		n, ok := nodes[id]
+		if !ok {
+			n = &fsckNode{identity: isIdentity(id)}
+			nodes[id] = n
+		}
+		return n
+	}
+	links := func(id cid.Cid, n *fsckNode) ([]cid.Cid, error) {
+		if n.identity {
+			return c.identityLinks(id)
+		}
+		ls, _, err := c.storedLinks(c.ds, id)
+		return ls, err
+	}
+	issue := func(category FsckCategory, id cid.Cid, format string, args ...interface{}) {
+		report.Issues = append(report.Issues, FsckIssue{Category: category, Cid: id, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	multihash := c.opt.KeyLayout == LayoutMultihash
+	shared := make(map[cid.Cid]*fsckData)
+	data := func(id cid.Cid) *fsckData {
+		d, ok := shared[id]
+		if !ok {
+			d = &fsckData{}
+			shared[id] = d
+		}
+		return d
+	}
+
+	rs, err := c.ds.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	for r := range rs.Next() {
+		if r.Error != nil {
+			rs.Close()
+			return nil, r.Error
+		}
+		if err := ctx.Err(); err != nil {
+			rs.Close()
+			return nil, err
+		}
+		id, kind, tail, err := c.keys.parseCidKey(r.Key)
+		if err != nil {
+			continue
+		}
+		switch {
+		case kind == counterSuffixKey && tail == "":
+			n := node(id)
+			n.hasCounter = true
+			v, err := c.ds.Get(datastore.RawKey(r.Key))
+			if err != nil {
+				rs.Close()
+				return nil, err
+			}
+			if n.count, n.meta, err = decodeCounter(v); err != nil {
+				n.corrupt = true
+				issue(FsckCorruptCounter, id, "%v", err)
+			}
+		case kind == dataSuffixKey && tail == "":
+			if multihash {
+				data(id).stored = true
+			} else {
+				node(id).hasData = true
+			}
+		case kind == linksSuffixKey && tail == "":
+			node(id).hasLinks = true
+		case multihash && kind == dataRefsSuffixKey && tail == "":
+			d := data(id)
+			if d.refs, _, err = getCountAt(c.ds, counterKey(datastore.RawKey(r.Key))); err != nil {
+				d.refs = -1
+			}
+		case (kind == tagSuffixKey || kind == hashedTagSuffixKey) && tail != "":
+			node(id).tags++
+		}
+	}
+	if err := rs.Close(); err != nil {
+		return nil, err
+	}
+
+	//in LayoutMultihash a cid has data if its link list was written when the shared data was stored
+	ids := make([]cid.Cid, 0, len(nodes))
+	for id, n := range nodes {
+		if multihash {
+			d := shared[c.dataID(id)]
+			n.hasData = d != nil && d.stored && n.hasLinks
+		}
+		ids = append(ids, id)
+	}
+
+	//decode links of all stored blocks and counted or tagged identity cids to count their stored parents
+	for len(ids) > 0 {
+		id := ids[len(ids)-1]
+		ids = ids[:len(ids)-1]
+		n := nodes[id]
+		if !n.hasData && !n.identity {
+			continue
+		}
+		ls, err := links(id, n)
+		if err != nil {
+			issue(FsckUndecodableData, id, "%v", err)
+			continue
+		}
+		n.decoded = true
+		for _, link := range ls {
+			if _, ok := nodes[link]; !ok && isIdentity(link) {
+				ids = append(ids, link) //an identity cid that is only linked
+			}
+			node(link).parents++
+		}
+	}
+
+	//count references from tags and Increment through the live graph, parents before their links
+	var ready, order []cid.Cid
+	for id, n := range nodes {
+		if n.parents == 0 {
+			ready = append(ready, id)
+		}
+	}
+	for len(ready) > 0 {
+		id := ready[len(ready)-1]
+		ready = ready[:len(ready)-1]
+		n := nodes[id]
+		n.refs += n.tags
+		if n.hasCounter && !n.corrupt && n.count > n.refs {
+			n.refs = n.count //references added by Increment
+		}
+		if !n.decoded {
+			continue
+		}
+		order = append(order, id)
+		ls, err := links(id, n)
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range ls {
+			l := nodes[link]
+			if n.refs > 0 {
+				l.refs++
+			}
+			if l.parents--; l.parents == 0 {
+				ready = append(ready, link)
+			}
+		}
+	}
+	//a cid is complete if its data and the data of all its links is stored, links before their parents
+	for i := len(order) - 1; i >= 0; i-- {
+		id := order[i]
+		n := nodes[id]
+		ls, err := links(id, n)
+		if err != nil {
+			return nil, err
+		}
+		n.complete = true
+		for _, link := range ls {
+			if !nodes[link].complete {
+				n.complete = false
+				break
+			}
+		}
+	}
+
+	for id, n := range nodes {
+		if n.identity {
+			continue //the counter of an identity cid is not required, its links are counted by the live graph
+		}
+		if !n.hasCounter && n.hasData {
+			issue(FsckDataWithoutCounter, id, "data is stored without a counter")
+		}
+		if n.hasCounter && !n.corrupt && n.meta.HavePart && !n.hasData {
+			issue(FsckCounterWithoutData, id, "counter %v has part, but no data is stored", n.count)
+		}
+		if !n.hasCounter && n.tags > 0 {
+			issue(FsckTagWithoutCounter, id, "%v tags without a counter", n.tags)
+		}
+		if !n.corrupt && n.count != n.refs {
+			issue(FsckCountMismatch, id, "count is %v, but %v tags and references are found", n.count, n.refs)
+		}
+		if !n.corrupt && n.count > 0 && n.meta.Complete != n.complete {
+			issue(FsckCompleteMismatch, id, "counter is marked complete:%v, but the stored DAG is complete:%v", n.meta.Complete, n.complete)
+		}
+	}
+	if multihash {
+		for id, n := range nodes {
+			if n.hasData && n.refs > 0 {
+				shared[c.dataID(id)].views++
+			}
+		}
+		for id, d := range shared {
+			if !d.stored {
+				continue
+			}
+			if d.views == 0 {
+				issue(FsckDataWithoutCounter, id, "data is not stored for any cid")
+			} else if d.refs != d.views {
+				issue(FsckDataRefsMismatch, id, "data has %v references, but %v cids store it", d.refs, d.views)
+			}
+		}
+	}
+	if !repair || len(report.Issues) == 0 {
+		return report, nil
+	}
+	for _, i := range report.Issues {
+		if i.Category == FsckUndecodableData {
+			return report, errors.Errorf("can not repair without the links of %v", i.Cid)
+		}
+	}
+
+	for id, n := range nodes {
+		meta := metadata{HavePart: n.hasData, Complete: n.complete}
+		if n.identity {
+			if n.corrupt {
+				if err := c.txWarp(ctx, func(tx *Tx) error {
+					return setCount(tx.transaction, c.getCounterKey(id), n.refs, metadata{Complete: true, HavePart: true})
+				}); err != nil {
+					return report, err
+				}
+				report.Repaired++
+			}
+			continue
+		}
+		if n.refs == 0 && !n.hasCounter && !n.hasData {
+			continue
+		}
+		if n.refs > 0 && n.hasCounter && !n.corrupt && n.count == n.refs &&
+			n.meta.Complete == meta.Complete && n.meta.HavePart == meta.HavePart {
+			continue
+		}
+		if err := c.txWarp(ctx, func(tx *Tx) error {
+			if n.refs == 0 {
+				if err := tx.transaction.Delete(datastore.Key(c.getCounterKey(id))); err != nil {
+					return err
+				}
+				return c.deleteBlock(tx.transaction, id)
+			}
+			if n.meta.HavePart && !meta.Complete {
+				meta.HaveBytes, meta.HaveBlocks = n.meta.HaveBytes, n.meta.HaveBlocks
+			}
+			if meta.HavePart && n.hasCounter && !n.corrupt && n.meta.SizeKnown {
+				meta = meta.withBlock(n.meta)
+			} else if meta.HavePart {
+				//data without a trusted counter is read from its header
+				stored, err := c.storedBlock(tx.transaction, id)
+				if err != nil {
+					return err
+				}
+				meta = meta.withBlock(stored)
+			}
+			return setCount(tx.transaction, c.getCounterKey(id), n.refs, meta)
+		}); err != nil {
+			return report, err
+		}
+		report.Repaired++
+	}
+	for id, d := range shared {
+		if !d.stored || d.refs == d.views {
+			continue
+		}
+		if err := c.txWarp(ctx, func(tx *Tx) error {
+			return tx.repairDataRefs(id, d.views)
+		}); err != nil {
+			return report, err
+		}
+		report.Repaired++
+	}
+	return report, nil
+}
+
+//repairDataRefs sets the reference count of data shared by multihash, data without references is deleted.
+func (c *Tx) repairDataRefs(dataID cid.Cid, refs int64) error {
+	_, meta, key, err := c.store.getBlockMeta(c.transaction, dataID)
+	if err != nil {
+		meta = metadata{} //rewrite a corrupted record
+	}
+	if refs == 0 {
+		if err := c.transaction.Delete(datastore.Key(key)); err != nil {
+			return err
+		}
+		return c.transaction.Delete(c.store.dataKey(dataID))
+	}
+	if !meta.SizeKnown {
+		//data without a trusted record is read from its header
+		if meta, err = c.store.storedBlock(c.transaction, dataID); err != nil {
+			return err
+		}
+	}
+	return setCount(c.transaction, key, refs, metadata{Complete: true, HavePart: true}.withBlock(meta))
+}
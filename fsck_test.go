@@ -0,0 +1,112 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/ipfs/go-merkledag"
+)
+
+func TestFsck(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	store, err := NewTagCountedStore(db, nil)
+	fatalIfErr(t, err)
+	ctx := context.Background()
+
+	fatalIfErr(t, store.PutTag(ctx, cids[0], datastore.NewKey("A"), getter))
+	fatalIfErr(t, store.PutTag(ctx, cids[1], datastore.NewKey("B"), getter))
+	report, err := store.Fsck(ctx, false)
+	fatalIfErr(t, err)
+	if len(report.Issues) != 0 {
+		t.Fatalf("unexpected issues %v", report.Issues)
+	}
+
+	//corrupt D's counter
+	fatalIfErr(t, db.Put(datastore.Key(store.getCounterKey(cids[3])), []byte{0}))
+	//store C without a counter
+	c, err := getter.GetBlock(ctx, cids[2])
+	fatalIfErr(t, err)
+	fatalIfErr(t, store.setData(db, cids[2], c))
+	//tag E without a counter
+	fatalIfErr(t, db.Put(store.getTagKey(cids[4], datastore.NewKey("X")), nil))
+	fatalIfErr(t, db.Delete(datastore.Key(store.getCounterKey(cids[4]))))
+	//count a block that is not stored
+	x := merkledag.NewRawNode([]byte("x")).Cid()
+	fatalIfErr(t, setCount(db, store.getCounterKey(x), 1, metadata{Complete: true}))
+
+	report, err = store.Fsck(ctx, true)
+	fatalIfErr(t, err)
+	found := make(map[FsckCategory]int)
+	for _, i := range report.Issues {
+		found[i.Category]++
+	}
+	for _, category := range []FsckCategory{
+		FsckCorruptCounter, FsckDataWithoutCounter, FsckCounterWithoutData, FsckTagWithoutCounter, FsckCountMismatch,
+	} {
+		if found[category] == 0 {
+			t.Errorf("expected %v in %v", category, report.Issues)
+		}
+	}
+	if report.Repaired != 4 {
+		t.Errorf("expected 4 repairs, got %v", report.Repaired)
+	}
+
+	report, err = store.Fsck(ctx, false)
+	fatalIfErr(t, err)
+	if len(report.Issues) != 0 {
+		t.Fatalf("unexpected issues after repair %v", report.Issues)
+	}
+	checkCounts(t, ctx, []int64{1, 1, 0, 2, 2, 3}, cids, store)
+	checkFullStoreByIterator(t, ctx, []cid.Cid{cids[0], cids[1], cids[3], cids[4], cids[5]}, store)
+}
+
+func TestFsckIncrement(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	store, err := NewTagCountedStore(db, nil)
+	fatalIfErr(t, err)
+	ctx := context.Background()
+
+	//A is held by Increment, D is shared with the tagged B
+	_, err = store.Increment(ctx, cids[0], getter)
+	fatalIfErr(t, err)
+	fatalIfErr(t, store.PutTag(ctx, cids[1], datastore.NewKey("B"), getter))
+	checkFsckClean(t, ctx, store)
+
+	//corrupt D's counter, repair keeps the DAG held by Increment
+	fatalIfErr(t, db.Put(datastore.Key(store.getCounterKey(cids[3])), []byte{0}))
+	report, err := store.Fsck(ctx, true)
+	fatalIfErr(t, err)
+	if report.Repaired != 1 {
+		t.Errorf("expected 1 repair, got %v in %v", report.Repaired, report.Issues)
+	}
+	checkFsckClean(t, ctx, store)
+	checkCounts(t, ctx, []int64{1, 1, 0, 2, 1, 3}, cids, store)
+	checkFullStoreByIterator(t, ctx, []cid.Cid{cids[0], cids[1], cids[3], cids[4], cids[5]}, store)
+}
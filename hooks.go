@@ -0,0 +1,88 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+)
+
+//Hooks are notified of block and tag changes.
+//They are called in order after the transaction that made the changes is committed,
+// changes from failed or retried commits are never reported.
+type Hooks interface {
+	//OnBlockStored is called when the data of a block is saved.
+	OnBlockStored(cid.Cid)
+	//OnBlockDeleted is called when the data of a block is deleted.
+	OnBlockDeleted(cid.Cid)
+	//OnRootTagged is called when a new tag is added to a cid.
+	OnRootTagged(cid.Cid, datastore.Key)
+	//OnRootUntagged is called when a tag is removed from a cid.
+	OnRootUntagged(cid.Cid, datastore.Key)
+}
+
+//HookFuncs implements Hooks with optional functions, nil functions are ignored.
+type HookFuncs struct {
+	BlockStored  func(cid.Cid)
+	BlockDeleted func(cid.Cid)
+	RootTagged   func(cid.Cid, datastore.Key)
+	RootUntagged func(cid.Cid, datastore.Key)
+}
+
+var _ Hooks = (*HookFuncs)(nil)
+
+func (h *HookFuncs) OnBlockStored(id cid.Cid) {
+	if h.BlockStored != nil {
+		h.BlockStored(id)
+	}
+}
+
+func (h *HookFuncs) OnBlockDeleted(id cid.Cid) {
+	if h.BlockDeleted != nil {
+		h.BlockDeleted(id)
+	}
+}
+
+func (h *HookFuncs) OnRootTagged(id cid.Cid, tag datastore.Key) {
+	if h.RootTagged != nil {
+		h.RootTagged(id, tag)
+	}
+}
+
+func (h *HookFuncs) OnRootUntagged(id cid.Cid, tag datastore.Key) {
+	if h.RootUntagged != nil {
+		h.RootUntagged(id, tag)
+	}
+}
+
+//fireHooks calls Hooks with changes from a committed transaction
+func (c *Tx) fireHooks() {
+	h := c.store.opt.Hooks
+	if h == nil {
+		return
+	}
+	for _, e := range c.events {
+		switch e.Kind {
+		case ChangeBlockStored:
+			h.OnBlockStored(e.Cid)
+		case ChangeBlockDeleted:
+			h.OnBlockDeleted(e.Cid)
+		case ChangeTagPut:
+			h.OnRootTagged(e.Cid, e.Tag)
+		case ChangeTagRemoved:
+			h.OnRootUntagged(e.Cid, e.Tag)
+		}
+	}
+}
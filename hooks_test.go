@@ -0,0 +1,69 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+)
+
+func TestHooks(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	//every transaction conflicts once before committing
+	db := newConflictDatastore(t, 1)
+	defer db.Close()
+	stored := cid.NewSet()
+	var deleted, tagged, untagged []cid.Cid
+	store, err := NewProgressiveTagCountedStore(db, &DatabaseOptions{
+		Hooks: &HookFuncs{
+			BlockStored: func(id cid.Cid) {
+				if !stored.Visit(id) {
+					t.Errorf("block %v reported stored twice", id)
+				}
+			},
+			BlockDeleted: func(id cid.Cid) { deleted = append(deleted, id) },
+			RootTagged:   func(id cid.Cid, _ datastore.Key) { tagged = append(tagged, id) },
+			RootUntagged: func(id cid.Cid, _ datastore.Key) { untagged = append(untagged, id) },
+		},
+	})
+	fatalIfErr(t, err)
+	ctx := context.Background()
+	tag := datastore.NewKey("tag")
+
+	fatalIfErr(t, store.PutTag(ctx, cids[0], tag, getter))
+	if stored.Len() != 3 || len(tagged) != 1 || tagged[0] != cids[0] {
+		t.Fatalf("unexpected events after PutTag: stored %v, tagged %v", stored.Keys(), tagged)
+	}
+	db.n = 1
+	fatalIfErr(t, store.ProgressivePutTag(ctx, cids[1], tag, getter).Run(ctx))
+	if stored.Len() != 5 || len(tagged) != 2 {
+		t.Fatalf("unexpected events after ProgressivePutTag: stored %v, tagged %v", stored.Keys(), tagged)
+	}
+	db.n = 1
+	fatalIfErr(t, store.RemoveTag(ctx, cids[0], tag))
+	if len(deleted) != 1 || deleted[0] != cids[0] || len(untagged) != 1 {
+		t.Fatalf("unexpected events after RemoveTag: deleted %v, untagged %v", deleted, untagged)
+	}
+	db.n = 1
+	fatalIfErr(t, store.RemoveTag(ctx, cids[1], tag))
+	if len(deleted) != 5 || len(untagged) != 2 {
+		t.Fatalf("unexpected events after RemoveTag: deleted %v, untagged %v", deleted, untagged)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+)
+
+//Identity cids contain their data inline, so they are never fetched or stored.
+//Identity cids that are added directly have a counter without data, and their links are
+// counted when the first reference is added, like the links of a stored block.
+//The counter is only kept to tell if a reference can be removed, Fsck does not require it.
+//A link to an identity cid is a reference to each of its links instead,
+// so link lists and progress only contain the links of identity cids.
+
+//isIdentity returns true if the data of id is inline in an identity multihash.
+func isIdentity(id cid.Cid) bool {
+	return id.Defined() && id.Prefix().MhType == multihash.IDENTITY
+}
+
+//identityData returns the inline data of an identity cid.
+func identityData(id cid.Cid) ([]byte, error) {
+	decoded, err := multihash.Decode(id.Hash())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return decoded.Digest, nil
+}
+
+//identityLinks decodes the links of an identity cid, with links of nested identity cids expanded.
+func (c *Counted) identityLinks(id cid.Cid) ([]cid.Cid, error) {
+	data, err := identityData(id)
+	if err != nil {
+		return nil, err
+	}
+	links, _, err := c.opt.LinkDecoder(id, data)
+	var notSupported *CodecNotSupportedError
+	if errors.As(err, &notSupported) && c.opt.UnknownCodecPolicy != CodecReject {
+		return nil, nil //an opaque leaf
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.expandIdentity(c.normalizeAll(links))
+}
+
+//expandIdentity replaces the identity cids in links with their own links.
+func (c *Counted) expandIdentity(links []cid.Cid) ([]cid.Cid, error) {
+	i := 0
+	for ; i < len(links); i++ {
+		if isIdentity(links[i]) {
+			break
+		}
+	}
+	if i == len(links) {
+		return links, nil //the common case without identity links
+	}
+	out := append([]cid.Cid(nil), links[:i]...)
+	for _, link := range links[i:] {
+		if !isIdentity(link) {
+			out = append(out, link)
+			continue
+		}
+		expanded, err := c.identityLinks(link)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, expanded...)
+	}
+	return out, nil
+}
+
+//forIdentityLinks calls f for each link of an identity cid.
+func (c *Tx) forIdentityLinks(id cid.Cid, f func(link cid.Cid) error) error {
+	links, err := c.store.identityLinks(id)
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		if err := f(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//countIdentity adds delta to the counter of an identity cid and returns the new count.
+//f is called for each link when the first reference is added or the last one is removed.
+//Removing a reference of an identity cid that was never added returns -1 and changes nothing.
+func (c *Tx) countIdentity(id cid.Cid, delta int64, f func(link cid.Cid) error) (int64, error) {
+	count, _, key, err := c.store.getCount(c.transaction, id)
+	if err != nil {
+		return 0, err
+	}
+	count += delta
+	if count < 0 {
+		return count, nil
+	}
+	if err := c.setCount(id, key, count, metadata{Complete: true, HavePart: true}); err != nil {
+		return 0, err
+	}
+	if (delta > 0 && count != 1) || (delta < 0 && count != 0) {
+		return count, nil
+	}
+	return count, c.forIdentityLinks(id, f)
+}
+
+//progressiveIdentity increments the counter of an identity cid, and the counters of its links
+// without fetching them if it is the first reference.
+//The incomplete links are continued by ProgressiveContinue.
+func (c *Tx) progressiveIdentity(id cid.Cid) (int64, error) {
+	return c.countIdentity(id, 1, func(link cid.Cid) error {
+		count, meta, key, err := c.store.getCount(c.transaction, link)
+		if err != nil {
+			return err
+		}
+		return c.setCount(link, key, count+1, meta)
+	})
+}
+
+//continueIdentity continues the incomplete links of an identity cid.
+func (c *ProgressiveCounted) continueIdentity(ctx context.Context, id cid.Cid, bg BlockGetter, undo func(tx *Tx) error) ProgressManager {
+	links, err := c.identityLinks(id)
+	if err != nil {
+		return &StoreProgressManager{err: err}
+	}
+	var ms progressManagers
+	for _, link := range links {
+		_, meta, _, err := c.getCount(c.ds, link)
+		if err != nil {
+			return &StoreProgressManager{err: err}
+		}
+		if !meta.Complete {
+			ms = append(ms, c.continueOrUndo(ctx, link, bg, undo))
+		}
+	}
+	if len(ms) == 0 {
+		return ProgressCompleted
+	}
+	return ms
+}
+
+//identityProgressReport sums the progress reports of the links of an identity cid.
+func (c *ProgressiveCounted) identityProgressReport(ctx context.Context, id cid.Cid, r *ProgressReport) error {
+	links, err := c.identityLinks(id)
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		var sub ProgressReport
+		if err := c.GetProgressReport(ctx, link, &sub); err != nil {
+			return err
+		}
+		r.HaveBytes += sub.HaveBytes
+		r.KnownBytes += sub.KnownBytes
+		r.HaveBlocks += sub.HaveBlocks
+	}
+	return nil
+}
+
+//progressManagers runs ProgressManagers one after another and sums their reports.
+type progressManagers []ProgressManager
+
+func (ms progressManagers) Run(ctx context.Context) error {
+	for _, m := range ms {
+		if err := m.Run(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms progressManagers) CopyReport(r *ProgressReport) error {
+	*r = ProgressReport{initalized: true}
+	for _, m := range ms {
+		var sub ProgressReport
+		if err := m.CopyReport(&sub); err != nil {
+			return err
+		}
+		r.HaveBytes += sub.HaveBytes
+		r.KnownBytes += sub.KnownBytes
+		r.HaveBlocks += sub.HaveBlocks
+	}
+	return nil
+}
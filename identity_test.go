@@ -0,0 +1,137 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestIdentity(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	tagA, tagB := datastore.NewKey("tagA"), datastore.NewKey("tagB")
+	d, f := cids[3], cids[5]
+
+	leafHash, err := multihash.Sum([]byte("inline"), multihash.IDENTITY, -1)
+	fatalIfErr(t, err)
+	leaf := cid.NewCidV1(cid.Raw, leafHash)
+	//an identity node linking to d and the identity leaf
+	node := &merkledag.ProtoNode{}
+	node.SetCidBuilder(cid.V1Builder{Codec: cid.DagProtobuf, MhType: multihash.IDENTITY})
+	fatalIfErr(t, node.AddRawLink("d", &ipld.Link{Cid: d}))
+	fatalIfErr(t, node.AddRawLink("leaf", &ipld.Link{Cid: leaf}))
+	//a stored block linking to the identity node
+	parent := &merkledag.ProtoNode{}
+	parent.SetCidBuilder(cidBuilder)
+	fatalIfErr(t, parent.AddRawLink("node", &ipld.Link{Cid: node.Cid()}))
+	getter.(mapBlockGetter)[parent.Cid()] = parent.RawData()
+
+	store, err := NewProgressiveTagCountedStore(db, nil)
+	fatalIfErr(t, err)
+	fatalIfErr(t, store.PutTag(ctx, leaf, tagA, mapBlockGetter{}))
+	data, err := store.GetBlock(ctx, leaf)
+	fatalIfErr(t, err)
+	if string(data) != "inline" {
+		t.Fatalf("unexpected inline data %q", data)
+	}
+	size, err := store.GetBlockSize(ctx, leaf)
+	fatalIfErr(t, err)
+	if size != len(data) {
+		t.Fatalf("unexpected size %v", size)
+	}
+	checkTags(t, ctx, leaf, []string{tagA.String()}, store)
+	//nothing but the tag and the counter is written for identity cids
+	rs, err := db.Query(query.Query{KeysOnly: true, Filters: []query.Filter{
+		query.FilterKeyCompare{Op: query.NotEqual, Key: schemaKey.String()},
+	}})
+	fatalIfErr(t, err)
+	es, err := rs.Rest()
+	fatalIfErr(t, err)
+	if len(es) != 2 {
+		t.Fatalf("expected only the tag and counter keys, got %v", es)
+	}
+
+	//an identity cid that was never added is not counted and can not be removed
+	checkCounts(t, ctx, []int64{0}, []cid.Cid{node.Cid()}, store)
+	fatalIfErr(t, store.PutTag(ctx, cids[0], tagA, getter))
+	if count, err := store.Decrement(ctx, node.Cid()); count != -1 || err != nil {
+		t.Fatalf("expected -1 from Decrement of an identity cid never added, got %v, %v", count, err)
+	}
+	checkCounts(t, ctx, []int64{1, 1, 1}, []cid.Cid{cids[0], d, f}, store)
+	fatalIfErr(t, store.RemoveTag(ctx, cids[0], tagA))
+
+	fatalIfErr(t, store.PutTag(ctx, parent.Cid(), tagA, getter))
+	fatalIfErr(t, store.PutTag(ctx, node.Cid(), tagB, getter))
+	fatalIfErr(t, store.PutTag(ctx, node.Cid(), tagA, getter))
+	checkCounts(t, ctx, []int64{1, 2, 1, 2, 1}, []cid.Cid{leaf, node.Cid(), parent.Cid(), d, f}, store)
+	checkFullStoreByIterator(t, ctx, []cid.Cid{parent.Cid(), d, f}, store)
+	checkFsckClean(t, ctx, &store.TagCounted)
+	//a corrupt counter of an identity cid is repaired
+	counter, err := db.Get(datastore.Key(store.getCounterKey(node.Cid())))
+	fatalIfErr(t, err)
+	fatalIfErr(t, db.Put(datastore.Key(store.getCounterKey(node.Cid())), []byte{0}))
+	report, err := store.Fsck(ctx, true)
+	fatalIfErr(t, err)
+	if report.Repaired != 1 {
+		t.Fatalf("expected the identity counter to be repaired, got %+v", report)
+	}
+	checkFsckClean(t, ctx, &store.TagCounted)
+	repaired, err := db.Get(datastore.Key(store.getCounterKey(node.Cid())))
+	fatalIfErr(t, err)
+	if !bytes.Equal(repaired, counter) {
+		t.Fatalf("expected the identity counter %v after repair, got %v", counter, repaired)
+	}
+	//the counter of an identity cid is not required
+	fatalIfErr(t, db.Delete(datastore.Key(store.getCounterKey(node.Cid()))))
+	checkFsckClean(t, ctx, &store.TagCounted)
+	fatalIfErr(t, db.Put(datastore.Key(store.getCounterKey(node.Cid())), counter))
+	fatalIfErr(t, store.RemoveTag(ctx, node.Cid(), tagA))
+	var r ProgressReport
+	fatalIfErr(t, store.GetProgressReport(ctx, node.Cid(), &r))
+	if r.KnownBytes == 0 || r.HaveBytes != r.KnownBytes {
+		t.Fatalf("unexpected progress report of the links of the identity node: %+v", r)
+	}
+
+	fatalIfErr(t, store.RemoveTag(ctx, parent.Cid(), tagA))
+	fatalIfErr(t, store.RemoveTag(ctx, node.Cid(), tagB))
+	fatalIfErr(t, store.RemoveTag(ctx, leaf, tagA))
+	checkFullStoreByIterator(t, ctx, nil, store)
+	checkFsckClean(t, ctx, &store.TagCounted)
+
+	//the links of an identity node are continued progressively
+	m := store.ProgressivePutTag(ctx, node.Cid(), tagB, getter)
+	fatalIfErr(t, m.Run(ctx))
+	fatalIfErr(t, m.CopyReport(&r))
+	if r.KnownBytes == 0 || r.HaveBytes != r.KnownBytes {
+		t.Fatalf("unexpected progress report after run: %+v", r)
+	}
+	checkCounts(t, ctx, []int64{1, 1}, []cid.Cid{d, f}, store)
+	checkFsckClean(t, ctx, &store.TagCounted)
+}
@@ -108,6 +108,9 @@ type TagStore interface {
 	//RemoveTag removes a tag set on the cid, the contents are also removed
 	//if there are no tags left.
 	RemoveTag(context.Context, cid.Cid, datastore.Key) error
+	//UpdateTag moves a tag from the old cid to the new cid atomically,
+	//only contents not shared by both cids are added or removed.
+	UpdateTag(ctx context.Context, tag datastore.Key, oldID, newID cid.Cid, bg BlockGetter) error
 }
 
 //TagCounterStore combines the features of both TagStore and CounterStore.
@@ -134,6 +137,9 @@ type ProgressReport struct {
 	HaveBytes uint64
 	//KnownBytes is the amount of bytes we need
 	KnownBytes uint64
+	//HaveBlocks is the amount of blocks stored by a partial upload,
+	// it is no longer tracked once the upload is complete.
+	HaveBlocks uint64
 }
 
 //ProgressiveCounterStore is a CounterStore that allows partial uploads
@@ -144,7 +150,8 @@ type ProgressiveCounterStore interface {
 	ProgressiveIncrement(context.Context, cid.Cid, BlockGetter) (ProgressManager, int64, error)
 	//ProgressiveContinue is ProgressiveIncrement without the increment to continue a previous partial ProgressiveIncrement.
 	ProgressiveContinue(context.Context, cid.Cid, BlockGetter) ProgressManager
-	//GetProgressReport reports the progress for a cid
+	//GetProgressReport reports the progress for a cid, progress made through other parents of
+	// shared blocks may only be included once the cid continues
 	GetProgressReport(context.Context, cid.Cid, *ProgressReport) error
 }
 
@@ -0,0 +1,286 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/pkg/errors"
+)
+
+//KeyEncoding decides how cids are encoded in datastore keys.
+type KeyEncoding uint8
+
+const (
+	//KeyEncodingBase64 writes the base64 encoded cid followed by the kind of record, this is the default.
+	KeyEncodingBase64 KeyEncoding = iota
+	//KeyEncodingBinary writes a short prefix of the kind of record followed by the raw cid bytes,
+	// so records of a kind are next to each other and keys are about a third shorter.
+	//It only works with datastores that accept arbitrary bytes in keys, like leveldb and badger.
+	//Use Counted.MigrateKeyEncoding to convert a store.
+	KeyEncodingBinary
+	//KeyEncodingBase32 writes the upper case base32 encoded cid followed by the kind of record,
+	// for datastores backed by case-insensitive filesystems.
+	//Plain tags are written as given, set TagHashKey to also have case-insensitive tag keys.
+	KeyEncodingBase32
+)
+
+//keyEncoding builds and parses the keys of the records of a cid.
+//A key is made of the cid, the kind of record and an optional tail, which is the tag of tag keys.
+type keyEncoding interface {
+	cidKey(id cid.Cid, kind datastore.Key, tail string) datastore.Key
+	//tailPrefix returns the prefix of all keys of a cid and kind with a tail
+	tailPrefix(id cid.Cid, kind datastore.Key) string
+	//kindPrefix returns the key all keys of a kind are below, as query.Query.Prefix,
+	// or "" if keys are not grouped by kind
+	kindPrefix(kind datastore.Key) string
+	//parseCidKey splits a key into its cid, kind and tail
+	parseCidKey(key string) (cid.Cid, datastore.Key, string, error)
+}
+
+func newKeyEncoding(e KeyEncoding) keyEncoding {
+	switch e {
+	case KeyEncodingBinary:
+		return binaryKeys{}
+	case KeyEncodingBase32:
+		return base32Keys
+	default:
+		return base64Keys
+	}
+}
+
+//textEncoding is implemented by base64.Encoding and base32.Encoding.
+type textEncoding interface {
+	EncodedLen(n int) int
+	Encode(dst, src []byte)
+	DecodeString(s string) ([]byte, error)
+}
+
+//textKeys writes "/", the multibase prefix and the encoded cid, then the kind of record and the tail.
+type textKeys struct {
+	prefix   byte
+	encoding textEncoding
+}
+
+//base64Keys is the encoding picked to be the same as NewKeyFromBinary in go-ipfs-ds-help.
+var base64Keys = textKeys{prefix: 'U', encoding: base64.URLEncoding}
+
+//base32Keys only has upper case letters and digits in the cid, like the keys of go-ipfs-ds-help.
+var base32Keys = textKeys{prefix: 'B', encoding: base32.StdEncoding.WithPadding(base32.NoPadding)}
+
+func (e textKeys) cidKey(id cid.Cid, kind datastore.Key, tail string) datastore.Key {
+	n := e.encoding.EncodedLen(id.ByteLen())
+	b := make([]byte, 2+n, 2+n+len(kind.String())+len(tail))
+	b[0] = '/'
+	b[1] = e.prefix
+	e.encoding.Encode(b[2:], id.Bytes())
+	b = append(b, kind.String()...)
+	b = append(b, tail...)
+	return datastore.RawKey(string(b))
+}
+
+func (e textKeys) tailPrefix(id cid.Cid, kind datastore.Key) string {
+	return e.cidKey(id, kind, "").String() + "/"
+}
+
+func (textKeys) kindPrefix(kind datastore.Key) string {
+	return ""
+}
+
+func (e textKeys) parseCidKey(s string) (cid.Cid, datastore.Key, string, error) {
+	if len(s) < 4 {
+		return cid.Cid{}, datastore.Key{}, "", errors.Errorf("key:%v is too short to contain cid", s)
+	}
+	if s[1] != e.prefix {
+		return cid.Cid{}, datastore.Key{}, "", errors.Errorf("key:%v does not start with multibase prefix %q", s, e.prefix)
+	}
+	i := strings.IndexByte(s[1:], '/') + 1
+	if i <= 2 || len(s) < i+2 || (len(s) > i+2 && s[i+2] != '/') {
+		return cid.Cid{}, datastore.Key{}, "", errors.Errorf("key:%v is not a key of a cid", s)
+	}
+	b, err := e.encoding.DecodeString(s[2:i])
+	if err != nil {
+		return cid.Cid{}, datastore.Key{}, "", err
+	}
+	id, err := cid.Cast(b)
+	if err != nil {
+		return cid.Cid{}, datastore.Key{}, "", err
+	}
+	return id, datastore.RawKey(s[i : i+2]), s[i+2:], nil
+}
+
+//binaryKeys writes "/", the letter of the kind of record, "/" and the cid bytes, then the tail.
+//The kind is a namespace of its own, so a query with its Prefix can seek to it.
+//Keys without a tail that would end with "/" get a zero byte appended,
+// since datastore keys can not end with "/".
+type binaryKeys struct{}
+
+func (e binaryKeys) cidKey(id cid.Cid, kind datastore.Key, tail string) datastore.Key {
+	b := make([]byte, 0, 4+id.ByteLen()+len(tail))
+	b = append(b, '/', kind.String()[1], '/')
+	b = append(b, id.Bytes()...)
+	b = append(b, tail...)
+	if b[len(b)-1] == '/' {
+		b = append(b, 0)
+	}
+	return datastore.RawKey(string(b))
+}
+
+func (binaryKeys) tailPrefix(id cid.Cid, kind datastore.Key) string {
+	return "/" + kind.String()[1:] + "/" + id.KeyString() + "/"
+}
+
+func (binaryKeys) kindPrefix(kind datastore.Key) string {
+	return "/" + kind.String()[1:]
+}
+
+func (binaryKeys) parseCidKey(s string) (cid.Cid, datastore.Key, string, error) {
+	if len(s) < 5 || s[0] != '/' || !isKeyKind(s[1]) || s[2] != '/' {
+		return cid.Cid{}, datastore.Key{}, "", errors.Errorf("key:%x is not a binary key of a cid", s)
+	}
+	n, id, err := cid.CidFromBytes([]byte(s[3:]))
+	if err != nil {
+		return cid.Cid{}, datastore.Key{}, "", err
+	}
+	tail := s[3+n:]
+	if tail == "\x00" {
+		tail = ""
+	}
+	if tail != "" && tail[0] != '/' {
+		return cid.Cid{}, datastore.Key{}, "", errors.Errorf("key:%x has an invalid tail", s)
+	}
+	return id, datastore.RawKey(s[:2]), tail, nil
+}
+
+//keyKinds are the letters of the kinds of records of a cid
+const keyKinds = "cdtholri"
+
+func isKeyKind(b byte) bool {
+	return strings.IndexByte(keyKinds, b) >= 0
+}
+
+//MigrateKeyEncoding rewrites the keys of all cids with another KeyEncoding and reseals the values
+// that use their key as additional data. The store uses the new encoding once it completes.
+//It uses one transaction per batch of keys and should not run concurrently with other actions.
+//If it is interrupted, MigrateStore or Migrate finishes it,
+// opening the store fails with ErrMigrationInProgress until then.
+//It returns the number of keys rewritten.
+func (c *Counted) MigrateKeyEncoding(ctx context.Context, to KeyEncoding) (int, error) {
+	if to == c.opt.KeyEncoding {
+		return 0, nil
+	}
+	return c.migrateTo(ctx, c.opt.KeyLayout, to)
+}
+
+//moveKeys rewrites the keys of c that are still in its encoding with another encoding, it is resumable.
+func (c *Counted) moveKeys(ctx context.Context, to KeyEncoding) (int, error) {
+	target := newKeyEncoding(to)
+	migrated := 0
+	//data and hashed tags are moved first, while the counters with their encryption flag can be read
+	for _, first := range []bool{true, false} {
+		rs, err := c.ds.Query(query.Query{KeysOnly: true})
+		if err != nil {
+			return migrated, err
+		}
+		es, err := rs.Rest()
+		if err != nil {
+			return migrated, err
+		}
+		var keys []string
+		for _, e := range es {
+			_, kind, _, err := c.keys.parseCidKey(e.Key)
+			if err != nil {
+				continue
+			}
+			if resealed := kind == dataSuffixKey || kind == hashedTagSuffixKey; resealed == first {
+				keys = append(keys, e.Key)
+			}
+		}
+		for len(keys) > 0 {
+			batch := keys
+			if len(batch) > migrateBatchSize {
+				batch = batch[:migrateBatchSize]
+			}
+			keys = keys[len(batch):]
+			var n int
+			if err := c.txWarp(ctx, func(tx *Tx) error {
+				n = 0
+				for _, key := range batch {
+					moved, err := tx.moveKey(key, target)
+					if err != nil {
+						return err
+					}
+					if moved {
+						n++
+					}
+				}
+				return nil
+			}); err != nil {
+				return migrated, err
+			}
+			migrated += n
+		}
+	}
+	return migrated, nil
+}
+
+//moveKey moves the value of a key of a cid to its key in the target encoding.
+func (c *Tx) moveKey(key string, target keyEncoding) (bool, error) {
+	old := datastore.RawKey(key)
+	value, err := c.transaction.Get(old)
+	if err == datastore.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	id, kind, tail, err := c.store.keys.parseCidKey(key)
+	if err != nil {
+		return false, err
+	}
+	next := target.cidKey(id, kind, tail)
+	if next == old {
+		return false, nil
+	}
+	switch kind {
+	case dataSuffixKey:
+		_, meta, _, err := c.store.getBlockMeta(c.transaction, id)
+		if err != nil {
+			return false, err
+		}
+		if value, err = c.store.resealData(value, meta, old, next); err != nil {
+			return false, err
+		}
+	case hashedTagSuffixKey:
+		if len(value) > 0 && value[0] == sealedMarker {
+			if value, err = c.store.openMarked(value, old.Bytes()); err != nil {
+				return false, err
+			}
+			if value, err = c.store.sealMarked(value, next.Bytes()); err != nil {
+				return false, err
+			}
+		}
+	}
+	if err := c.transaction.Put(next, value); err != nil {
+		return false, err
+	}
+	return true, c.transaction.Delete(old)
+}
@@ -0,0 +1,295 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+)
+
+var keyEncodings = map[string]KeyEncoding{
+	"base64": KeyEncodingBase64,
+	"binary": KeyEncodingBinary,
+	"base32": KeyEncodingBase32,
+}
+
+func Test_keyEncoding(t *testing.T) {
+	cids, _ := setup(t)
+	//a cid with bytes ending in "/"
+	slash, err := multihash.Sum([]byte("a/"), multihash.IDENTITY, -1)
+	fatalIfErr(t, err)
+	ids := append(cids, cid.NewCidV1(cid.Raw, slash), cid.NewCidV0(cids[0].Hash()))
+	for name, e := range keyEncodings {
+		keys := newKeyEncoding(e)
+		for _, id := range ids {
+			for _, kind := range []datastore.Key{counterSuffixKey, dataSuffixKey, linksSuffixKey} {
+				key := keys.cidKey(id, kind, "")
+				if prefix := keys.kindPrefix(kind); prefix != "" && !datastore.NewKey(prefix).IsAncestorOf(key) {
+					t.Errorf("%v: key %q is not below the prefix of its kind %q", name, key, prefix)
+				}
+				gotID, gotKind, tail, err := keys.parseCidKey(key.String())
+				fatalIfErr(t, err, name, key)
+				if !gotID.Equals(id) || gotKind != kind || tail != "" {
+					t.Errorf("%v: key %q parsed to %v %v %q", name, key, gotID, gotKind, tail)
+				}
+			}
+			tag := datastore.NewKey("some/tag")
+			key := keys.cidKey(id, tagSuffixKey, tag.String())
+			if !strings.HasPrefix(key.String(), keys.tailPrefix(id, tagSuffixKey)) {
+				t.Errorf("%v: tag key %q does not start with its prefix", name, key)
+			}
+			gotID, gotKind, tail, err := keys.parseCidKey(key.String())
+			fatalIfErr(t, err, name, key)
+			if !gotID.Equals(id) || gotKind != tagSuffixKey || tail != tag.String() {
+				t.Errorf("%v: tag key %q parsed to %v %v %q", name, key, gotID, gotKind, tail)
+			}
+		}
+		for _, key := range []string{schemaKey.String(), getChangeKey(1).String(), "/", "/x"} {
+			if _, _, _, err := keys.parseCidKey(key); err == nil {
+				t.Errorf("%v: expected %q not to be parsed as a key of a cid", name, key)
+			}
+		}
+	}
+}
+
+func TestBinaryKeys(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	tagA, tagB := datastore.NewKey("tagA"), datastore.NewKey("tagB")
+
+	store, err := NewTagCountedStore(db, &DatabaseOptions{KeyEncoding: KeyEncodingBinary})
+	fatalIfErr(t, err)
+	fatalIfErr(t, store.PutTag(ctx, cids[0], tagA, getter))
+	fatalIfErr(t, store.PutTag(ctx, cids[1], tagB, getter))
+	checkCounts(t, ctx, []int64{1, 1, 0, 2, 1, 3}, cids, store)
+	checkTags(t, ctx, cids[1], []string{tagB.String()}, store)
+	checkFullStoreByIterator(t, ctx, []cid.Cid{cids[0], cids[1], cids[3], cids[4], cids[5]}, store)
+	checkFsckClean(t, ctx, store)
+	//the counters are found by the prefix of their kind
+	if stats, err := store.BlockStats(ctx); err != nil || stats.Blocks != 5 {
+		t.Fatalf("expected 5 blocks, got %+v, %v", stats, err)
+	}
+	if _, err := NewTagCountedStore(db, nil); !errors.Is(err, ErrKeyEncodingMismatch) {
+		t.Fatalf("expected ErrKeyEncodingMismatch, got %v", err)
+	}
+	fatalIfErr(t, store.RemoveTag(ctx, cids[0], tagA))
+	fatalIfErr(t, store.RemoveTag(ctx, cids[1], tagB))
+	checkFullStoreByIterator(t, ctx, nil, store)
+}
+
+func TestBase32Keys(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	tagA, tagB := datastore.NewKey("tagA"), datastore.NewKey("TAGa")
+
+	opt := &DatabaseOptions{KeyEncoding: KeyEncodingBase32, TagHashKey: []byte("secret")}
+	store, err := NewTagCountedStore(db, opt)
+	fatalIfErr(t, err)
+	fatalIfErr(t, store.PutTag(ctx, cids[0], tagA, getter))
+	fatalIfErr(t, store.PutTag(ctx, cids[0], tagB, getter))
+	fatalIfErr(t, store.PutTag(ctx, cids[1], tagB, getter))
+	checkCounts(t, ctx, []int64{2, 1, 0, 2, 1, 3}, cids, store)
+	checkTags(t, ctx, cids[0], []string{tagB.String(), tagA.String()}, store)
+	checkFullStoreByIterator(t, ctx, []cid.Cid{cids[0], cids[1], cids[3], cids[4], cids[5]}, store)
+	checkFsckClean(t, ctx, store)
+
+	rs, err := db.Query(query.Query{KeysOnly: true})
+	fatalIfErr(t, err)
+	es, err := rs.Rest()
+	fatalIfErr(t, err)
+	folded := make(map[string]string)
+	for _, e := range es {
+		if other, ok := folded[strings.ToLower(e.Key)]; ok {
+			t.Errorf("keys %q and %q only differ in case", e.Key, other)
+		}
+		folded[strings.ToLower(e.Key)] = e.Key
+	}
+}
+
+func TestMigrateKeyEncoding(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	tagA, tagB := datastore.NewKey("tagA"), datastore.NewKey("tagB")
+
+	keys, err := NewAESKeyring(1, bytes.Repeat([]byte{1}, 32))
+	fatalIfErr(t, err)
+	opt := &DatabaseOptions{ChangeLog: true, Keyring: keys, TagHashKey: []byte("secret"), Compression: Snappy}
+	store, err := NewTagCountedStore(db, opt)
+	fatalIfErr(t, err)
+	fatalIfErr(t, store.PutTag(ctx, cids[0], tagA, getter))
+	fatalIfErr(t, store.PutTag(ctx, cids[1], tagB, getter))
+
+	n, err := store.MigrateKeyEncoding(ctx, KeyEncodingBinary)
+	fatalIfErr(t, err)
+	if n == 0 {
+		t.Fatal("expected keys to be migrated")
+	}
+	opt.KeyEncoding = KeyEncodingBinary
+	store, err = NewTagCountedStore(db, opt)
+	fatalIfErr(t, err)
+	checkCounts(t, ctx, []int64{1, 1, 0, 2, 1, 3}, cids, store)
+	checkTags(t, ctx, cids[1], []string{tagB.String()}, store)
+	checkFullStoreByIterator(t, ctx, []cid.Cid{cids[0], cids[1], cids[3], cids[4], cids[5]}, store)
+	checkFsckClean(t, ctx, store)
+	for _, id := range cids[3:] {
+		data, err := store.GetBlock(ctx, id)
+		fatalIfErr(t, err)
+		want, err := getter.GetBlock(ctx, id)
+		fatalIfErr(t, err)
+		if !bytes.Equal(data, want) {
+			t.Fatalf("unexpected data of %v after migration", id)
+		}
+	}
+	if n, err = store.MigrateKeyEncoding(ctx, KeyEncodingBinary); n != 0 || err != nil {
+		t.Fatalf("expected nothing left to migrate, got %v, %v", n, err)
+	}
+}
+
+func TestMigrateKeyEncodingInterrupted(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	ctx := context.Background()
+	tagA, tagB := datastore.NewKey("tagA"), datastore.NewKey("tagB")
+	keys, err := NewAESKeyring(1, bytes.Repeat([]byte{1}, 32))
+	fatalIfErr(t, err)
+
+	for _, finish := range []string{"MigrateStore", "Migrate"} {
+		db, err := leveldb.NewDatastore("", nil)
+		fatalIfErr(t, err)
+		defer db.Close()
+		opt := &DatabaseOptions{Keyring: keys}
+		store, err := NewTagCountedStore(db, opt)
+		fatalIfErr(t, err)
+		fatalIfErr(t, store.PutTag(ctx, cids[0], tagA, getter))
+		fatalIfErr(t, store.PutTag(ctx, cids[1], tagB, getter))
+		_, err = NewScrubber(&store.Counted, &ScrubOptions{MaxBlocks: 1}).Run(ctx)
+		fatalIfErr(t, err)
+		position, err := db.Get(scrubPositionKey)
+		fatalIfErr(t, err)
+		scrubbed, err := store.keyToCid(string(position), dataSuffixKey)
+		fatalIfErr(t, err)
+
+		//interrupted after the target is saved and one data value is moved
+		fatalIfErr(t, store.txWarp(ctx, func(tx *Tx) error {
+			return tx.setSchema(func(s *schema) {
+				s.Migrating, s.NextLayout, s.NextEncoding = true, LayoutCid, KeyEncodingBinary
+			})
+		}))
+		fatalIfErr(t, store.txWarp(ctx, func(tx *Tx) error {
+			_, err := tx.moveKey(store.dataKey(cids[5]).String(), binaryKeys{})
+			return err
+		}))
+		if _, err := NewTagCountedStore(db, opt); !errors.Is(err, ErrMigrationInProgress) {
+			t.Fatalf("%v: expected ErrMigrationInProgress, got %v", finish, err)
+		}
+
+		opt.KeyEncoding = KeyEncodingBinary
+		if _, err := NewTagCountedStore(db, opt); !errors.Is(err, ErrMigrationInProgress) {
+			t.Fatalf("%v: expected ErrMigrationInProgress with the target options, got %v", finish, err)
+		}
+		var n int
+		if finish == "Migrate" {
+			n, err = store.Migrate(ctx)
+		} else {
+			n, err = MigrateStore(ctx, db, &DatabaseOptions{Keyring: keys})
+		}
+		fatalIfErr(t, err)
+		if n != 1 {
+			t.Fatalf("%v: expected 1 migration, got %v", finish, n)
+		}
+		s, err := getSchema(db)
+		fatalIfErr(t, err)
+		if s.Migrating || s.Encoding != KeyEncodingBinary {
+			t.Fatalf("%v: unexpected schema after migration %+v", finish, s)
+		}
+		store, err = NewTagCountedStore(db, opt)
+		fatalIfErr(t, err)
+		checkCounts(t, ctx, []int64{1, 1, 0, 2, 1, 3}, cids, store)
+		checkTags(t, ctx, cids[1], []string{tagB.String()}, store)
+		checkFullStoreByIterator(t, ctx, []cid.Cid{cids[0], cids[1], cids[3], cids[4], cids[5]}, store)
+		checkFsckClean(t, ctx, store)
+		position, err = db.Get(scrubPositionKey)
+		fatalIfErr(t, err)
+		if id, err := store.keyToCid(string(position), dataSuffixKey); err != nil || id != scrubbed {
+			t.Fatalf("%v: expected the scrub position at %v, got %v, %v", finish, scrubbed, id, err)
+		}
+	}
+}
+
+func BenchmarkKeyEncoding(b *testing.B) {
+	cids, _ := setup(b)
+	id := cids[1]
+	tag := datastore.NewKey("tag").String()
+	for name, e := range keyEncodings {
+		keys := newKeyEncoding(e)
+		b.Run(name, func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				key := keys.cidKey(id, tagSuffixKey, tag)
+				if _, _, _, err := keys.parseCidKey(key.String()); err != nil {
+					b.Fatal(err)
+				}
+				size = len(key.String())
+			}
+			b.ReportMetric(float64(size), "B/key")
+		})
+	}
+}
+
+func BenchmarkPutRemoveTagKeyEncoding(b *testing.B) {
+	cids, getter := setup(b)
+	ctx := context.Background()
+	id := cids[1]
+	tag := datastore.NewKey("tag")
+	for name, e := range keyEncodings {
+		b.Run(name, func(b *testing.B) {
+			db, err := leveldb.NewDatastore("", nil)
+			fatalIfErr(b, err)
+			defer db.Close()
+			store, err := NewTagCountedStore(db, &DatabaseOptions{KeyEncoding: e})
+			fatalIfErr(b, err)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				fatalIfErr(b, store.PutTag(ctx, id, tag, getter))
+				fatalIfErr(b, store.RemoveTag(ctx, id, tag))
+			}
+		})
+	}
+}
@@ -15,40 +15,29 @@
 package sharedforeststore
 
 import (
-	"bytes"
-	"encoding/base64"
 	"encoding/binary"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
-//newKeyFromCid creates a new key from a cid with suffixes.
-//The encoding picked is the same as NewKeyFromBinary in go-ipfs-ds-help.
-func newKeyFromCid(id cid.Cid, suffixKeys ...datastore.Key) datastore.Key {
-	encoding := base64.URLEncoding
-	keyLen := 2 + encoding.EncodedLen(id.ByteLen())
-	for _, k := range suffixKeys {
-		keyLen += len(k.String())
-	}
-	b := make([]byte, 2, keyLen)
-	b[0] = '/'
-	b[1] = 85 //id for base64.URLEncoding
-	buf := bytes.NewBuffer(b)
-	encoder := base64.NewEncoder(encoding, buf)
-	if _, err := id.WriteBytes(encoder); err != nil {
-		panic(err) // error here should be impossible
-	}
-	if err := encoder.Close(); err != nil {
-		panic(err) // error here should be impossible
-	}
-	for _, k := range suffixKeys {
-		if _, err := buf.WriteString(k.String()); err != nil {
-			panic(err) // error here should be impossible
-		}
+//cidKey returns the key of a kind of record of a cid
+func (c *Counted) cidKey(id cid.Cid, kind datastore.Key) datastore.Key {
+	return c.keys.cidKey(id, kind, "")
+}
+
+//keyToCid returns the cid of a key of the given kind without a tail
+func (c *Counted) keyToCid(s string, kind datastore.Key) (cid.Cid, error) {
+	id, k, tail, err := c.keys.parseCidKey(s)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	if k != kind || tail != "" {
+		return cid.Cid{}, errors.Errorf("key:%v is not a %v key", s, kind)
 	}
-	return datastore.RawKey(buf.String())
+	return id, nil
 }
 
 type readWriteStore interface {
@@ -60,55 +49,211 @@ var counterSuffixKey = datastore.NewKey("/c")
 
 type counterKey datastore.Key
 
-func getCounterKey(id cid.Cid) counterKey {
-	return counterKey(newKeyFromCid(id, counterSuffixKey))
+func (c *Counted) getCounterKey(id cid.Cid) counterKey {
+	return counterKey(c.cidKey(id, counterSuffixKey))
 }
 
 type metadata struct {
 	Complete bool
 	HavePart bool
+	//HaveBytes and HaveBlocks are the aggregated progress of a partial upload.
+	//They are only kept while HavePart is true and Complete is false.
+	HaveBytes  uint64
+	HaveBlocks uint64
+	//Size is the byte size of the stored block, it is only valid if SizeKnown is true.
+	//Counters of the first format version do not have it until MigrateBlockSizes is run.
+	Size      uint64
+	SizeKnown bool
+	//Encoded is true if the stored data has a compression header, it requires SizeKnown.
+	Encoded bool
+	//Encrypted is true if the stored data is sealed by the Keyring, it requires SizeKnown.
+	Encrypted bool
+	//Header is true if the stored data starts with a data header, it requires SizeKnown.
+	//Data written before SchemaVersion 2 has no header and is decoded with Encoded and Encrypted.
+	Header bool
 }
 
+//counter flags of the first format version are written after the count for incomplete counters,
+// a complete counter is the count only.
+const (
+	flagNoPart       = 0
+	flagHavePart     = 1
+	flagWithProgress = 2 //HavePart followed by varints of HaveBytes and HaveBlocks
+)
+
+//The second format version is used for all counters with a stored block of known size.
+//The count is followed by flagVersion2 with the bits below, a varint of Size,
+// then varints of HaveBytes and HaveBlocks if flagV2Progress is set.
+const (
+	flagVersion2    = 0x10
+	flagV2Complete  = 0x01
+	flagV2Progress  = 0x02
+	flagV2Encoded   = 0x04
+	flagV2Encrypted = 0x08
+	flagV2Header    = 0x20
+	flagV2Mask      = flagV2Complete | flagV2Progress | flagV2Encoded | flagV2Encrypted | flagV2Header
+)
+
 func decodeCounter(bs []byte) (int64, metadata, error) {
 	c, size := binary.Uvarint(bs)
 	count := int64(c)
 	if count <= 0 {
 		return 0, metadata{}, errors.Errorf("corrupted metadata error: count less than 1, from raw `%x`", bs)
 	}
-	switch len(bs) {
-	case size:
+	if len(bs) == size {
 		return count, metadata{Complete: true, HavePart: true}, nil
-	case size + 1:
-		if bs[size] > 1 {
-			return 0, metadata{}, errors.Errorf("corrupted metadata error: meta > 1, from raw `%x`", bs)
+	}
+	if bs[size]&^flagV2Mask == flagVersion2 {
+		return decodeCounterV2(count, bs[size], bs[size+1:], bs)
+	}
+	switch bs[size] {
+	case flagNoPart, flagHavePart:
+		if len(bs) != size+1 {
+			return 0, metadata{}, errors.Errorf("corrupted metadata error: length too long, from raw `%x`", bs)
+		}
+		return count, metadata{Complete: false, HavePart: bs[size] == flagHavePart}, nil
+	case flagWithProgress:
+		rest := bs[size+1:]
+		haveBytes, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return 0, metadata{}, errors.Errorf("corrupted metadata error: bad progress bytes, from raw `%x`", bs)
+		}
+		rest = rest[n:]
+		haveBlocks, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return 0, metadata{}, errors.Errorf("corrupted metadata error: bad progress blocks, from raw `%x`", bs)
 		}
-		return count, metadata{Complete: false, HavePart: bs[size] == 1}, nil
+		if len(rest) != n {
+			return 0, metadata{}, errors.Errorf("corrupted metadata error: length too long, from raw `%x`", bs)
+		}
+		return count, metadata{HavePart: true, HaveBytes: haveBytes, HaveBlocks: haveBlocks}, nil
 	default:
+		return 0, metadata{}, errors.Errorf("corrupted metadata error: meta > %v, from raw `%x`", flagWithProgress, bs)
+	}
+}
+
+func decodeCounterV2(count int64, flag byte, rest, bs []byte) (int64, metadata, error) {
+	meta := metadata{
+		HavePart:  true,
+		Complete:  flag&flagV2Complete != 0,
+		SizeKnown: true,
+		Encoded:   flag&flagV2Encoded != 0,
+		Encrypted: flag&flagV2Encrypted != 0,
+		Header:    flag&flagV2Header != 0,
+	}
+	var n int
+	if meta.Size, n = binary.Uvarint(rest); n <= 0 {
+		return 0, metadata{}, errors.Errorf("corrupted metadata error: bad size, from raw `%x`", bs)
+	}
+	rest = rest[n:]
+	if flag&flagV2Progress != 0 {
+		if meta.HaveBytes, n = binary.Uvarint(rest); n <= 0 {
+			return 0, metadata{}, errors.Errorf("corrupted metadata error: bad progress bytes, from raw `%x`", bs)
+		}
+		rest = rest[n:]
+		if meta.HaveBlocks, n = binary.Uvarint(rest); n <= 0 {
+			return 0, metadata{}, errors.Errorf("corrupted metadata error: bad progress blocks, from raw `%x`", bs)
+		}
+		rest = rest[n:]
+	}
+	if len(rest) != 0 {
 		return 0, metadata{}, errors.Errorf("corrupted metadata error: length too long, from raw `%x`", bs)
 	}
+	return count, meta, nil
 }
 
 func (m metadata) encodeWithCount(c int64) []byte {
-	padding := 0
-	if !m.Complete {
-		padding = 1
-	}
-	buf := make([]byte, binary.MaxVarintLen64+padding)
+	buf := make([]byte, 1+4*binary.MaxVarintLen64)
 	n := binary.PutUvarint(buf, uint64(c))
-	if m.HavePart && !m.Complete {
-		buf[n] = 1
+	if m.HavePart && m.SizeKnown {
+		return m.encodeV2(buf, n)
+	}
+	if m.Complete {
+		return buf[:n]
+	}
+	switch {
+	case m.HavePart && (m.HaveBytes != 0 || m.HaveBlocks != 0):
+		buf[n] = flagWithProgress
+		n++
+		n += binary.PutUvarint(buf[n:], m.HaveBytes)
+		n += binary.PutUvarint(buf[n:], m.HaveBlocks)
+		return buf[:n]
+	case m.HavePart:
+		buf[n] = flagHavePart
+	default:
+		buf[n] = flagNoPart
+	}
+	return buf[:n+1]
+}
+
+func (m metadata) encodeV2(buf []byte, n int) []byte {
+	flag := byte(flagVersion2)
+	progress := !m.Complete && (m.HaveBytes != 0 || m.HaveBlocks != 0)
+	if m.Complete {
+		flag |= flagV2Complete
+	}
+	if progress {
+		flag |= flagV2Progress
+	}
+	if m.Encoded {
+		flag |= flagV2Encoded
+	}
+	if m.Encrypted {
+		flag |= flagV2Encrypted
+	}
+	if m.Header {
+		flag |= flagV2Header
+	}
+	buf[n] = flag
+	n++
+	n += binary.PutUvarint(buf[n:], m.Size)
+	if progress {
+		n += binary.PutUvarint(buf[n:], m.HaveBytes)
+		n += binary.PutUvarint(buf[n:], m.HaveBlocks)
 	}
-	return buf[:n+padding]
+	return buf[:n]
 }
 
-func getCount(db datastore.Read, id cid.Cid) (int64, metadata, counterKey, error) {
-	key := getCounterKey(id)
+//withBlock returns m with the stored block fields of stored: its size and encoding
+func (m metadata) withBlock(stored metadata) metadata {
+	m.Size, m.SizeKnown = stored.Size, stored.SizeKnown
+	m.Encoded, m.Encrypted, m.Header = stored.Encoded, stored.Encrypted, stored.Header
+	return m
+}
+
+func (c *Counted) getCount(db datastore.Read, id cid.Cid) (int64, metadata, counterKey, error) {
+	key := c.getCounterKey(id)
+	count, meta, err := c.countAt(db, id, key)
+	return count, meta, key, err
+}
+
+//countAt is getCountAt for the record of id, decode failures are logged and returned with the cid.
+func (c *Counted) countAt(db datastore.Read, id cid.Cid, key counterKey) (int64, metadata, error) {
 	v, err := db.Get(datastore.Key(key))
 	if err == datastore.ErrNotFound {
-		return 0, metadata{}, key, nil
+		return 0, metadata{}, nil
+	}
+	if err != nil {
+		return 0, metadata{}, err
 	}
 	count, meta, err := decodeCounter(v)
-	return count, meta, key, err
+	if err != nil {
+		c.log.Error("corrupted counter", cidField(id), zap.Error(err))
+		return 0, metadata{}, errors.Wrapf(err, "counter of %v", id)
+	}
+	return count, meta, nil
+}
+
+//getCountAt reads a record in the counter encoding, it is zero if not found
+func getCountAt(db datastore.Read, key counterKey) (int64, metadata, error) {
+	v, err := db.Get(datastore.Key(key))
+	if err == datastore.ErrNotFound {
+		return 0, metadata{}, nil
+	}
+	if err != nil {
+		return 0, metadata{}, err
+	}
+	return decodeCounter(v)
 }
 
 func setCount(db datastore.Write, k0 counterKey, v int64, meta metadata) error {
@@ -124,40 +269,61 @@ func setCount(db datastore.Write, k0 counterKey, v int64, meta metadata) error {
 
 var dataSuffixKey = datastore.NewKey("/d")
 
-func getDataKey(id cid.Cid) datastore.Key {
-	return newKeyFromCid(id, dataSuffixKey)
+func (c *Counted) getDataKey(id cid.Cid) datastore.Key {
+	return c.cidKey(id, dataSuffixKey)
 }
 
-func dataKeyToCid(s string) (cid.Cid, error) {
-	if len(s) < 4 {
-		return cid.Cid{}, errors.Errorf("key:%v is too short to contain cid", s)
-	}
-	return cid.Decode(s[1 : len(s)-len(dataSuffixKey.String())])
+func (c *Counted) setData(db datastore.Write, id cid.Cid, data []byte) error {
+	return db.Put(c.getDataKey(id), data)
 }
 
-func setData(db datastore.Write, id cid.Cid, data []byte) error {
-	return db.Put(getDataKey(id), data)
-}
+var opaqueSuffixKey = datastore.NewKey("/o")
 
-func deleteData(db readWriteStore, id cid.Cid) ([]byte, error) {
-	key := getDataKey(id)
-	data, err := db.Get(key)
-	if err != nil {
-		return nil, err
-	}
-	return data, db.Delete(key)
+//getOpaqueKey returns the key marking a block stored without decoding its links
+func (c *Counted) getOpaqueKey(id cid.Cid) datastore.Key {
+	return c.cidKey(id, opaqueSuffixKey)
 }
 
 var tagSuffixKey = datastore.NewKey("/t")
 
-func getTagKey(id cid.Cid, tag datastore.Key) datastore.Key {
-	return newKeyFromCid(id, tagSuffixKey, tag)
+func (c *Counted) getTagKey(id cid.Cid, tag datastore.Key) datastore.Key {
+	return c.keys.cidKey(id, tagSuffixKey, tag.String())
+}
+
+//tagKeyToCid splits a tag key into its cid and tag.
+func (c *Counted) tagKeyToCid(s string) (cid.Cid, datastore.Key, error) {
+	return c.splitTagKey(s, tagSuffixKey)
+}
+
+var hashedTagSuffixKey = datastore.NewKey("/h")
+
+//getHashedTagKey returns the key of a tag stored by its keyed hash, see DatabaseOptions.TagHashKey
+func (c *Counted) getHashedTagKey(id cid.Cid, hash string) datastore.Key {
+	return c.keys.cidKey(id, hashedTagSuffixKey, hash)
+}
+
+//hashedTagKeyToCid returns the cid of a hashed tag key, the tag is in its value.
+func (c *Counted) hashedTagKeyToCid(s string) (cid.Cid, error) {
+	id, _, err := c.splitTagKey(s, hashedTagSuffixKey)
+	return id, err
+}
+
+//splitTagKey splits a key of a kind with a tail into its cid and tail.
+func (c *Counted) splitTagKey(s string, kind datastore.Key) (cid.Cid, datastore.Key, error) {
+	id, k, tail, err := c.keys.parseCidKey(s)
+	if err != nil {
+		return cid.Cid{}, datastore.Key{}, err
+	}
+	if k != kind || tail == "" {
+		return cid.Cid{}, datastore.Key{}, errors.Errorf("key:%v is not a tag key", s)
+	}
+	return id, datastore.RawKey(tail), nil
 }
 
 var internalTagSuffixKey = datastore.NewKey("/i")
 
-func getInternalTagKey(id cid.Cid, tag datastore.Key) datastore.Key {
-	return newKeyFromCid(id, internalTagSuffixKey, tag)
+func (c *Counted) getInternalTagKey(id cid.Cid, tag datastore.Key) datastore.Key {
+	return c.keys.cidKey(id, internalTagSuffixKey, tag.String())
 }
 
-var _ = getInternalTagKey //block used warnings during development
+var _ = (*Counted).getInternalTagKey //block used warnings during development
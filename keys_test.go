@@ -65,6 +65,46 @@ func Test_encodeDecodeCounter(t *testing.T) {
 		count:   1,
 		meta:    metadata{Complete: false, HavePart: false},
 		wantErr: false,
+	}, {
+		name:    "short progress err",
+		bs:      []byte{1, 2, 3},
+		wantErr: true,
+	}, {
+		name:    "long progress err",
+		bs:      []byte{1, 2, 3, 4, 5},
+		wantErr: true,
+	}, {
+		name:    "2 with progress",
+		bs:      []byte{2, 2, 0x80, 1, 3},
+		count:   2,
+		meta:    metadata{Complete: false, HavePart: true, HaveBytes: 128, HaveBlocks: 3},
+		wantErr: false,
+	}, {
+		name:    "1 complete with size",
+		bs:      []byte{1, 0x11, 0x80, 1},
+		count:   1,
+		meta:    metadata{Complete: true, HavePart: true, Size: 128, SizeKnown: true},
+		wantErr: false,
+	}, {
+		name:    "1 have part with size",
+		bs:      []byte{1, 0x10, 0},
+		count:   1,
+		meta:    metadata{Complete: false, HavePart: true, SizeKnown: true},
+		wantErr: false,
+	}, {
+		name:    "2 with size and progress",
+		bs:      []byte{2, 0x12, 5, 0x80, 1, 3},
+		count:   2,
+		meta:    metadata{Complete: false, HavePart: true, HaveBytes: 128, HaveBlocks: 3, Size: 5, SizeKnown: true},
+		wantErr: false,
+	}, {
+		name:    "missing size err",
+		bs:      []byte{1, 0x11},
+		wantErr: true,
+	}, {
+		name:    "long size err",
+		bs:      []byte{1, 0x11, 5, 0},
+		wantErr: true,
 	}}
 	for _, tt := range tests {
 		t.Run("decode "+tt.name, func(t *testing.T) {
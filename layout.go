@@ -0,0 +1,442 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/pkg/errors"
+)
+
+//KeyLayout decides how blocks are keyed in the datastore.
+type KeyLayout uint8
+
+const (
+	//LayoutCid keys everything by the full cid, this is the default.
+	LayoutCid KeyLayout = iota
+	//LayoutMultihash keys block data by multihash, so cids of the same content with another version
+	// or codec share the stored data. Counters, link lists and tags stay per cid to keep the codec
+	// needed for link decoding, CIDv0 are keyed as their CIDv1 so both versions share them too.
+	//Use Counted.MigrateToMultihash to convert a store written with LayoutCid.
+	LayoutMultihash
+)
+
+var dataRefsSuffixKey = datastore.NewKey("/r")
+
+//getDataRefsKey returns the key of the record that counts the cids sharing the data of a multihash,
+// it also keeps the stored block fields of the data.
+func (c *Counted) getDataRefsKey(dataID cid.Cid) counterKey {
+	return counterKey(c.cidKey(dataID, dataRefsSuffixKey))
+}
+
+//normalize returns the cid that keys the counter, link list and tags of id.
+func (c *Counted) normalize(id cid.Cid) cid.Cid {
+	if c.opt.KeyLayout == LayoutMultihash && id.Version() == 0 {
+		return cid.NewCidV1(cid.DagProtobuf, id.Hash())
+	}
+	return id
+}
+
+//normalizeAll normalizes cids in place
+func (c *Counted) normalizeAll(ids []cid.Cid) []cid.Cid {
+	if c.opt.KeyLayout != LayoutMultihash {
+		return ids
+	}
+	for i, id := range ids {
+		ids[i] = c.normalize(id)
+	}
+	return ids
+}
+
+//dataID returns the cid that keys the data of id.
+func (c *Counted) dataID(id cid.Cid) cid.Cid {
+	if c.opt.KeyLayout == LayoutMultihash {
+		return cid.NewCidV1(cid.Raw, id.Hash())
+	}
+	return id
+}
+
+//dataKey returns the key of the data of id.
+func (c *Counted) dataKey(id cid.Cid) datastore.Key {
+	return c.getDataKey(c.dataID(id))
+}
+
+//blockMetaKey returns the key of the record with the stored block fields of the data of id:
+// its counter, or the data refs record in LayoutMultihash.
+func (c *Counted) blockMetaKey(id cid.Cid) counterKey {
+	if c.opt.KeyLayout == LayoutMultihash {
+		return c.getDataRefsKey(c.dataID(id))
+	}
+	return c.getCounterKey(id)
+}
+
+//blockMetaSuffix returns the key suffix of the records returned by blockMetaKey
+func (c *Counted) blockMetaSuffix() datastore.Key {
+	if c.opt.KeyLayout == LayoutMultihash {
+		return dataRefsSuffixKey
+	}
+	return counterSuffixKey
+}
+
+//storedSuffix returns the key suffix that exists for every stored cid,
+// in LayoutMultihash data is keyed by a raw cid, so the link lists that keep the codec are used.
+func (c *Counted) storedSuffix() datastore.Key {
+	if c.opt.KeyLayout == LayoutMultihash {
+		return linksSuffixKey
+	}
+	return dataSuffixKey
+}
+
+//getBlockMeta returns the record with the stored block fields of the data of id.
+func (c *Counted) getBlockMeta(db datastore.Read, id cid.Cid) (int64, metadata, counterKey, error) {
+	key := c.blockMetaKey(id)
+	count, meta, err := c.countAt(db, id, key)
+	return count, meta, key, err
+}
+
+//sharedData returns the data of id and its stored block fields if it is already stored for another cid
+// in LayoutMultihash, or false if the data needs to be stored.
+func (c *Counted) sharedData(db datastore.Read, id cid.Cid) ([]byte, metadata, bool, error) {
+	if c.opt.KeyLayout != LayoutMultihash {
+		return nil, metadata{}, false, nil
+	}
+	refs, meta, _, err := c.getBlockMeta(db, id)
+	if refs == 0 || err != nil {
+		return nil, metadata{}, false, err
+	}
+	data, err := c.getData(db, id)
+	return data, meta, err == nil, err
+}
+
+//shareData adds a reference to the data of id found by sharedData.
+func (c *Tx) shareData(id cid.Cid) error {
+	refs, meta, key, err := c.store.getBlockMeta(c.transaction, id)
+	if err != nil {
+		return err
+	}
+	return setCount(c.transaction, key, refs+1, meta)
+}
+
+//deleteBlock removes the link list and opaque marker of a block with its data,
+// data shared with other cids is kept until the last one is removed.
+func (c *Counted) deleteBlock(db readWriteStore, id cid.Cid) error {
+	if err := db.Delete(c.getLinksKey(id)); err != nil {
+		return err
+	}
+	if err := db.Delete(c.getOpaqueKey(id)); err != nil {
+		return err
+	}
+	if c.opt.KeyLayout == LayoutMultihash {
+		refs, meta, key, err := c.getBlockMeta(db, id)
+		if err != nil {
+			return err
+		}
+		if refs > 1 {
+			return setCount(db, key, refs-1, meta)
+		}
+		if err := db.Delete(datastore.Key(key)); err != nil {
+			return err
+		}
+	}
+	return db.Delete(c.dataKey(id))
+}
+
+//migrateDupKey prefixes the cids that were stored as both CIDv0 and CIDv1 before MigrateToMultihash,
+// their links were counted once for each and are decremented after all cids are merged.
+var migrateDupKey = datastore.NewKey("/migrate/multihash/dup")
+
+//MigrateToMultihash converts a store written with LayoutCid to LayoutMultihash, the store uses LayoutMultihash
+// once it completes.
+//CIDv0 counters, link lists and tags are merged into their CIDv1, and data is moved to its multihash key.
+//It uses one transaction per multihash and should not run concurrently with other actions.
+//If it is interrupted, MigrateStore or Migrate finishes it,
+// opening the store fails with ErrMigrationInProgress until then.
+//It returns the number of multihashes changed.
+func (c *Counted) MigrateToMultihash(ctx context.Context) (int, error) {
+	if c.opt.KeyLayout == LayoutMultihash {
+		return 0, nil
+	}
+	return c.migrateTo(ctx, LayoutMultihash, c.opt.KeyEncoding)
+}
+
+//migrateToMultihash merges the records of a store written with LayoutCid into c, which has LayoutMultihash,
+// it is resumable.
+func (c *Counted) migrateToMultihash(ctx context.Context) (int, error) {
+	rs, err := c.ds.Query(query.Query{KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	es, err := rs.Rest()
+	if err != nil {
+		return 0, err
+	}
+	groups := make(map[string]*cid.Set)
+	for _, e := range es {
+		id, kind, tail, err := c.keys.parseCidKey(e.Key)
+		if err != nil || tail != "" || (kind != counterSuffixKey && kind != dataSuffixKey) || isIdentity(id) {
+			continue
+		}
+		g, ok := groups[string(id.Hash())]
+		if !ok {
+			g = cid.NewSet()
+			groups[string(id.Hash())] = g
+		}
+		g.Add(id)
+	}
+	migrated := 0
+	for _, g := range groups {
+		var changed bool
+		if err := c.txWarp(ctx, func(tx *Tx) (err error) {
+			changed, err = tx.migrateMultihash(g.Keys())
+			return err
+		}); err != nil {
+			return migrated, err
+		}
+		if changed {
+			migrated++
+		}
+	}
+
+	rs, err = c.ds.Query(query.Query{Prefix: migrateDupKey.String(), KeysOnly: true})
+	if err != nil {
+		return migrated, err
+	}
+	if es, err = rs.Rest(); err != nil {
+		return migrated, err
+	}
+	for _, e := range es {
+		if err := c.txWarp(ctx, func(tx *Tx) error {
+			return tx.fixDuplicate(datastore.RawKey(e.Key))
+		}); err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+//migrateMultihash migrates all cids with the same multihash.
+func (c *Tx) migrateMultihash(ids []cid.Cid) (bool, error) {
+	s := c.store
+	dataID := s.dataID(ids[0])
+	refs, _, _, err := s.getBlockMeta(c.transaction, dataID)
+	if err != nil {
+		return false, err
+	}
+	var data []byte
+	if refs > 0 {
+		if data, err = s.getData(c.transaction, dataID); err != nil {
+			return false, err
+		}
+	}
+	changed := false
+	for _, id := range ids {
+		key := c.store.getDataKey(id)
+		value, err := c.transaction.Get(key)
+		if err == datastore.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if data == nil {
+			_, meta, _, err := c.store.getCount(c.transaction, id)
+			if err != nil {
+				return false, err
+			}
+			if data, err = s.decodeData(key, value, meta); err != nil {
+				return false, err
+			}
+		}
+		if key != s.dataKey(id) {
+			if err := c.transaction.Delete(key); err != nil {
+				return false, err
+			}
+			changed = true
+		}
+	}
+	views := cid.NewSet()
+	for _, id := range ids {
+		if id != s.normalize(id) {
+			if err := c.mergeView(id, s.normalize(id)); err != nil {
+				return false, err
+			}
+			changed = true
+		}
+		_, meta, _, err := c.store.getCount(c.transaction, s.normalize(id))
+		if err != nil {
+			return false, err
+		}
+		if meta.HavePart {
+			views.Add(s.normalize(id))
+		}
+	}
+	if data == nil || views.Len() == 0 {
+		//data without cids is removed, cids without data are left for Fsck
+		return changed, c.repairDataRefs(dataID, 0)
+	}
+	if refs == int64(views.Len()) && !changed {
+		return false, nil //already migrated
+	}
+	if _, err := c.putData(dataID, data); err != nil {
+		return false, err
+	}
+	if err := c.repairDataRefs(dataID, int64(views.Len())); err != nil {
+		return false, err
+	}
+	//link lists show which cids are stored, blocks stored before they existed are decoded again
+	return true, views.ForEach(func(id cid.Cid) error {
+		has, err := c.transaction.Has(c.store.getLinksKey(id))
+		if has || err != nil {
+			return err
+		}
+		links, size, err := s.storedLinks(c.transaction, id)
+		if err != nil {
+			return err
+		}
+		return c.store.setLinks(c.transaction, id, links, size)
+	})
+}
+
+//mergeView merges the counter, link list and tags of a CIDv0 into its CIDv1.
+func (c *Tx) mergeView(from, to cid.Cid) error {
+	c0, m0, k0, err := c.store.getCount(c.transaction, from)
+	if err != nil {
+		return err
+	}
+	c1, m1, k1, err := c.store.getCount(c.transaction, to)
+	if err != nil {
+		return err
+	}
+	for _, suffix := range []datastore.Key{tagSuffixKey, hashedTagSuffixKey} {
+		rs, err := c.transaction.Query(query.Query{
+			Filters: []query.Filter{query.FilterKeyPrefix{Prefix: c.store.keys.tailPrefix(from, suffix)}},
+		})
+		if err != nil {
+			return err
+		}
+		es, err := rs.Rest()
+		if err != nil {
+			return err
+		}
+		for _, e := range es {
+			old := datastore.RawKey(e.Key)
+			_, tail, err := c.store.splitTagKey(e.Key, suffix)
+			if err != nil {
+				continue
+			}
+			key := c.store.keys.cidKey(to, suffix, tail.String())
+			has, err := c.transaction.Has(key)
+			if err != nil {
+				return err
+			}
+			if has {
+				c0-- //the same tag was put on both cids
+			} else {
+				value := e.Value
+				if suffix == hashedTagSuffixKey && len(value) > 0 && value[0] == sealedMarker {
+					if value, err = c.store.openMarked(value, old.Bytes()); err != nil {
+						return err
+					}
+					if value, err = c.store.sealMarked(value, key.Bytes()); err != nil {
+						return err
+					}
+				}
+				if err := c.transaction.Put(key, value); err != nil {
+					return err
+				}
+			}
+			if err := c.transaction.Delete(old); err != nil {
+				return err
+			}
+		}
+	}
+	for _, suffix := range []datastore.Key{linksSuffixKey, opaqueSuffixKey} {
+		value, err := c.transaction.Get(c.store.cidKey(from, suffix))
+		if err == datastore.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !m1.HavePart {
+			if err := c.transaction.Put(c.store.cidKey(to, suffix), value); err != nil {
+				return err
+			}
+		}
+		if err := c.transaction.Delete(c.store.cidKey(from, suffix)); err != nil {
+			return err
+		}
+	}
+	if c0 < 0 {
+		c0 = 0
+	}
+	meta := m1
+	if !m1.HavePart || (m0.Complete && !m1.Complete) {
+		meta = m0
+	}
+	if m0.HavePart && m1.HavePart {
+		if err := c.addDuplicate(to); err != nil {
+			return err
+		}
+	}
+	if err := c.transaction.Delete(datastore.Key(k0)); err != nil {
+		return err
+	}
+	return setCount(c.transaction, k1, c0+c1, meta)
+}
+
+func (c *Tx) addDuplicate(id cid.Cid) error {
+	key := migrateDupKey.ChildString(id.String())
+	n := uint64(0)
+	if v, err := c.transaction.Get(key); err == nil {
+		n, _ = binary.Uvarint(v)
+	} else if err != datastore.ErrNotFound {
+		return err
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	return c.transaction.Put(key, buf[:binary.PutUvarint(buf, n+1)])
+}
+
+//fixDuplicate removes the extra references to the links of a cid that was stored as both CIDv0 and CIDv1.
+func (c *Tx) fixDuplicate(key datastore.Key) error {
+	v, err := c.transaction.Get(key)
+	if err == datastore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	n, _ := binary.Uvarint(v)
+	id, err := cid.Decode(key.BaseNamespace())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	links, _, err := c.store.storedLinks(c.transaction, id)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		for _, link := range links {
+			if _, err := c.decrement(link); err != nil {
+				return err
+			}
+		}
+	}
+	return c.transaction.Delete(key)
+}
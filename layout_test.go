@@ -0,0 +1,162 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/pkg/errors"
+)
+
+//setupViews adds the CIDv0 of a and the raw cid of d to the cids and BlockGetter of setup.
+func setupViews(t testing.TB) ([]cid.Cid, cid.Cid, cid.Cid, BlockGetter) {
+	cids, getter := setup(t)
+	m := getter.(mapBlockGetter)
+	a0 := cid.NewCidV0(cids[0].Hash())
+	dRaw := cid.NewCidV1(cid.Raw, cids[3].Hash())
+	m[a0] = m[cids[0]]
+	m[dRaw] = m[cids[3]]
+	return cids, a0, dRaw, getter
+}
+
+func checkFsckClean(t testing.TB, ctx context.Context, store *TagCounted) {
+	t.Helper()
+	report, err := store.Fsck(ctx, false)
+	fatalIfErr(t, err)
+	if len(report.Issues) != 0 {
+		t.Fatalf("unexpected issues: %v", report.Issues)
+	}
+}
+
+func TestMultihashLayout(t *testing.T) {
+	t.Parallel()
+
+	cids, a0, dRaw, getter := setupViews(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	tagA, tagB, tagC := datastore.NewKey("tagA"), datastore.NewKey("tagB"), datastore.NewKey("tagC")
+	a, d, f := cids[0], cids[3], cids[5]
+
+	store, err := NewTagCountedStore(db, &DatabaseOptions{KeyLayout: LayoutMultihash})
+	fatalIfErr(t, err)
+	fatalIfErr(t, store.PutTag(ctx, a0, tagA, getter))
+	fatalIfErr(t, store.PutTag(ctx, a, tagB, getter))
+	fatalIfErr(t, store.PutTag(ctx, dRaw, tagC, getter))
+	//CIDv0 and CIDv1 share a counter, the raw view of d only shares its data
+	checkCounts(t, ctx, []int64{2, 2, 1, 1, 1}, []cid.Cid{a, a0, d, dRaw, f}, store)
+	checkTags(t, ctx, a0, []string{tagA.String(), tagB.String()}, store)
+	checkFullStoreByIterator(t, ctx, []cid.Cid{a, d, dRaw, f}, store)
+	checkFsckClean(t, ctx, store)
+	refs, _, _, err := store.getBlockMeta(db, d)
+	fatalIfErr(t, err)
+	if refs != 2 {
+		t.Fatalf("expected data of d to have 2 references, got %v", refs)
+	}
+
+	fatalIfErr(t, store.RemoveTag(ctx, a, tagA))
+	fatalIfErr(t, store.RemoveTag(ctx, a0, tagB))
+	checkCounts(t, ctx, []int64{0, 0, 1, 0}, []cid.Cid{a, d, dRaw, f}, store)
+	data, err := store.GetBlock(ctx, dRaw)
+	fatalIfErr(t, err)
+	want, err := getter.GetBlock(ctx, d)
+	fatalIfErr(t, err)
+	if !bytes.Equal(data, want) {
+		t.Fatal("shared data of d was not kept for its raw view")
+	}
+	checkFullStoreByIterator(t, ctx, []cid.Cid{dRaw}, store)
+	checkFsckClean(t, ctx, store)
+
+	//moving a tag between the versions of a cid keeps it
+	fatalIfErr(t, store.PutTag(ctx, a0, tagA, getter))
+	fatalIfErr(t, store.UpdateTag(ctx, tagA, a0, a, getter))
+	if has, err := store.HasTag(ctx, a, tagA); !has || err != nil {
+		t.Fatalf("expected tag to be kept, got %v, %v", has, err)
+	}
+	checkCounts(t, ctx, []int64{1, 1, 1}, []cid.Cid{a, a0, d}, store)
+	fatalIfErr(t, store.RemoveTag(ctx, a, tagA))
+
+	fatalIfErr(t, store.RemoveTag(ctx, dRaw, tagC))
+	checkFullStoreByIterator(t, ctx, nil, store)
+	if _, err := store.GetBlock(ctx, d); err != datastore.ErrNotFound {
+		t.Fatalf("expected data to be deleted with the last reference, got %v", err)
+	}
+}
+
+func TestMigrateToMultihash(t *testing.T) {
+	t.Parallel()
+
+	cids, a0, dRaw, getter := setupViews(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	tagA, tagB, tagC := datastore.NewKey("tagA"), datastore.NewKey("tagB"), datastore.NewKey("tagC")
+	a, d, f := cids[0], cids[3], cids[5]
+
+	old, err := NewTagCountedStore(db, &DatabaseOptions{Compression: Snappy})
+	fatalIfErr(t, err)
+	fatalIfErr(t, old.PutTag(ctx, a0, tagA, getter))
+	fatalIfErr(t, old.PutTag(ctx, a, tagA, getter))
+	fatalIfErr(t, old.PutTag(ctx, a, tagB, getter))
+	fatalIfErr(t, old.PutTag(ctx, dRaw, tagC, getter))
+	checkCounts(t, ctx, []int64{1, 2, 2, 1, 1}, []cid.Cid{a0, a, d, dRaw, f}, old)
+
+	if _, err := NewTagCountedStore(db, &DatabaseOptions{KeyLayout: LayoutMultihash}); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected a store to be opened with its layout before the migration, got %v", err)
+	}
+	store := old
+	n, err := store.MigrateToMultihash(ctx)
+	fatalIfErr(t, err)
+	if n != 3 {
+		t.Fatalf("expected 3 multihashes to be migrated, got %v", n)
+	}
+	//the tag put on both versions of a is only counted once
+	checkCounts(t, ctx, []int64{2, 2, 1, 1, 1}, []cid.Cid{a, a0, d, dRaw, f}, store)
+	checkTags(t, ctx, a0, []string{tagA.String(), tagB.String()}, store)
+	checkFullStoreByIterator(t, ctx, []cid.Cid{a, d, dRaw, f}, store)
+	checkFsckClean(t, ctx, store)
+	//the data of both versions of a and both codecs of d is stored once
+	if stats, err := store.BlockStats(ctx); err != nil || stats.Blocks != 3 || stats.UnknownSize != 0 {
+		t.Fatalf("unexpected block stats %+v, %v", stats, err)
+	}
+	for _, id := range []cid.Cid{a0, dRaw} {
+		data, err := store.GetBlock(ctx, id)
+		fatalIfErr(t, err)
+		want, err := getter.GetBlock(ctx, id)
+		fatalIfErr(t, err)
+		if !bytes.Equal(data, want) {
+			t.Fatalf("unexpected data of %v after migration", id)
+		}
+	}
+
+	n, err = store.MigrateToMultihash(ctx)
+	fatalIfErr(t, err)
+	if n != 0 {
+		t.Fatalf("expected migration to be done, but %v multihashes changed", n)
+	}
+	if _, err := NewTagCountedStore(db, nil); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected a migrated store to require LayoutMultihash, got %v", err)
+	}
+	reopened, err := NewTagCountedStore(db, &DatabaseOptions{KeyLayout: LayoutMultihash})
+	fatalIfErr(t, err)
+	checkCounts(t, ctx, []int64{2, 2, 1, 1, 1}, []cid.Cid{a, a0, d, dRaw, f}, reopened)
+}
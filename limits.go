@@ -0,0 +1,99 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+)
+
+//IngestLimits limits the blocks fetched from BlockGetter by a single put, zero values are unlimited.
+//For single transaction puts, the limits apply to the whole transaction and nothing is committed if
+// a limit is exceeded. For progressive puts, the limits apply to the whole run and the put is removed
+// by the transaction that exceeded a limit, a run from ProgressiveContinue keeps the earlier put.
+type IngestLimits struct {
+	//MaxBlockSize is the maximum size of a block in bytes
+	MaxBlockSize int
+	//MaxLinks is the maximum number of links in a block
+	MaxLinks int
+	//MaxBlocks is the maximum number of blocks fetched
+	MaxBlocks uint64
+	//MaxBytes is the maximum number of bytes fetched
+	MaxBytes uint64
+}
+
+//IngestLimit names a field of IngestLimits.
+type IngestLimit string
+
+const (
+	LimitBlockSize IngestLimit = "MaxBlockSize"
+	LimitLinks     IngestLimit = "MaxLinks"
+	LimitBlocks    IngestLimit = "MaxBlocks"
+	LimitBytes     IngestLimit = "MaxBytes"
+)
+
+//IngestLimitError is returned when a put exceeded one of the IngestLimits.
+type IngestLimitError struct {
+	Limit IngestLimit
+	//Cid is the block that exceeded the limit
+	Cid cid.Cid
+	//Value is the value that exceeded the limit
+	Value uint64
+	//Max is the configured limit
+	Max uint64
+}
+
+func (e *IngestLimitError) Error() string {
+	return fmt.Sprintf("ingest limit %v exceeded by block %v: %v > %v", e.Limit, e.Cid, e.Value, e.Max)
+}
+
+//ingestState tracks blocks fetched against IngestLimits
+type ingestState struct {
+	limits IngestLimits
+	blocks uint64
+	bytes  uint64
+}
+
+//addBlock counts a fetched block
+func (s *ingestState) addBlock(id cid.Cid, data []byte) error {
+	l := &s.limits
+	if l.MaxBlockSize > 0 && len(data) > l.MaxBlockSize {
+		return &IngestLimitError{Limit: LimitBlockSize, Cid: id, Value: uint64(len(data)), Max: uint64(l.MaxBlockSize)}
+	}
+	s.blocks++
+	s.bytes += uint64(len(data))
+	if l.MaxBlocks > 0 && s.blocks > l.MaxBlocks {
+		return &IngestLimitError{Limit: LimitBlocks, Cid: id, Value: s.blocks, Max: l.MaxBlocks}
+	}
+	if l.MaxBytes > 0 && s.bytes > l.MaxBytes {
+		return &IngestLimitError{Limit: LimitBytes, Cid: id, Value: s.bytes, Max: l.MaxBytes}
+	}
+	return nil
+}
+
+//checkLinks checks the number of links decoded from a fetched block
+func (s *ingestState) checkLinks(id cid.Cid, links []cid.Cid) error {
+	if max := s.limits.MaxLinks; max > 0 && len(links) > max {
+		return &IngestLimitError{Limit: LimitLinks, Cid: id, Value: uint64(len(links)), Max: uint64(max)}
+	}
+	return nil
+}
+
+//SetIngestLimits replaces the IngestLimits from DatabaseOptions for puts in this transaction.
+//It should be called at the start of each Update, since a retry starts with the default limits.
+func (c *Tx) SetIngestLimits(l IngestLimits) {
+	c.ingest.limits = l
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/pkg/errors"
+)
+
+func TestIngestLimits(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	ctx := context.Background()
+	tag := datastore.NewKey("tag")
+	expectLimit := func(err error, limit IngestLimit) {
+		t.Helper()
+		var le *IngestLimitError
+		if !errors.As(err, &le) || le.Limit != limit {
+			t.Fatalf("expected %v to be exceeded, got %v", limit, err)
+		}
+	}
+
+	cases := []struct {
+		limits IngestLimits
+		node   int
+		limit  IngestLimit
+	}{
+		{limits: IngestLimits{MaxBlocks: 2}, node: 0, limit: LimitBlocks},
+		{limits: IngestLimits{MaxLinks: 1}, node: 1, limit: LimitLinks},
+		{limits: IngestLimits{MaxBlockSize: 20}, node: 0, limit: LimitBlockSize},
+		{limits: IngestLimits{MaxBytes: 50}, node: 0, limit: LimitBytes},
+	}
+	for _, c := range cases {
+		db, err := leveldb.NewDatastore("", nil)
+		fatalIfErr(t, err)
+		defer db.Close()
+		store, err := NewProgressiveTagCountedStore(db, &DatabaseOptions{IngestLimits: c.limits})
+		fatalIfErr(t, err)
+		expectLimit(store.PutTag(ctx, cids[c.node], tag, getter), c.limit)
+		checkFullStoreByIterator(t, ctx, nil, store)
+		checkCounts(t, ctx, make([]int64, len(cids)), cids, store)
+
+		//progressive puts are removed when a limit is exceeded
+		expectLimit(store.ProgressivePutTag(ctx, cids[c.node], tag, getter).Run(ctx), c.limit)
+		checkFullStoreByIterator(t, ctx, nil, store)
+		checkCounts(t, ctx, make([]int64, len(cids)), cids, store)
+		checkTags(t, ctx, cids[c.node], nil, store)
+		m, _, err := store.ProgressiveIncrement(ctx, cids[c.node], getter)
+		fatalIfErr(t, err)
+		expectLimit(m.Run(ctx), c.limit)
+		checkFullStoreByIterator(t, ctx, nil, store)
+		checkCounts(t, ctx, make([]int64, len(cids)), cids, store)
+
+		//a continued put is kept
+		_, _, err = store.ProgressiveIncrement(ctx, cids[c.node], getter)
+		fatalIfErr(t, err)
+		expectLimit(store.ProgressiveContinue(ctx, cids[c.node], getter).Run(ctx), c.limit)
+		if count, err := store.Decrement(ctx, cids[c.node]); count != 0 || err != nil {
+			t.Fatalf("expected the continued put to be kept, got count %v, %v", count, err)
+		}
+		checkFullStoreByIterator(t, ctx, nil, store)
+
+		//a resumed tag put only continues the tag added earlier, which is kept
+		store.ProgressivePutTag(ctx, cids[c.node], tag, getter)
+		expectLimit(store.ProgressivePutTag(ctx, cids[c.node], tag, getter).Run(ctx), c.limit)
+		checkTags(t, ctx, cids[c.node], []string{tag.String()}, store)
+		fatalIfErr(t, store.RemoveTag(ctx, cids[c.node], tag))
+		checkFullStoreByIterator(t, ctx, nil, store)
+
+		//limits per transaction replace the default
+		fatalIfErr(t, store.Update(ctx, func(tx *Tx) error {
+			tx.SetIngestLimits(IngestLimits{})
+			return tx.PutTag(cids[c.node], tag, getter)
+		}))
+	}
+
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	store, err := NewTagCountedStore(db, nil)
+	fatalIfErr(t, err)
+	expectLimit(store.Update(ctx, func(tx *Tx) error {
+		tx.SetIngestLimits(IngestLimits{MaxBlocks: 2})
+		return tx.PutTag(cids[0], tag, getter)
+	}), LimitBlocks)
+	fatalIfErr(t, store.PutTag(ctx, cids[0], tag, getter))
+}
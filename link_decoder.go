@@ -15,15 +15,25 @@
 package sharedforeststore
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"sync"
 
-	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
 	ipld "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-merkledag"
 	"github.com/pkg/errors"
 )
 
+//multicodecs not defined in go-cid
+const (
+	DagJSON = 0x0129
+	DagJOSE = 0x85
+)
+
 type CodecNotSupportedError struct {
 	Cid cid.Cid
 }
@@ -32,46 +42,186 @@ func (e *CodecNotSupportedError) Error() string {
 	return fmt.Sprintf("codec %v is not supported in CID %v", e.Cid.Prefix().GetCodec(), e.Cid)
 }
 
+//SizeEstimatorFunc estimates the total size of all contents linked from a block.
+//It is used when the decoder of a codec does not return a size.
+type SizeEstimatorFunc func(id cid.Cid, data []byte, links []cid.Cid) uint64
+
+type codecEntry struct {
+	decoder LinkDecoderFunc
+	size    SizeEstimatorFunc
+}
+
+//CodecRegistry is a LinkDecoderFunc that decodes blocks by the multicodec of their cid.
+type CodecRegistry struct {
+	lock   sync.RWMutex
+	codecs map[uint64]codecEntry
+}
+
+//NewCodecRegistry creates a CodecRegistry with the built-in codecs:
+// Raw, DagProtobuf, DagCBOR, DagJSON and DagJOSE.
+func NewCodecRegistry() *CodecRegistry {
+	r := &CodecRegistry{codecs: make(map[uint64]codecEntry)}
+	r.Register(cid.Raw, decodeRaw, nil)
+	r.Register(cid.DagProtobuf, decodeProtobuf, nil)
+	r.Register(cid.DagCBOR, decodeCBOR, nil)
+	r.Register(DagJSON, decodeJSON, nil)
+	r.Register(DagJOSE, decodeCBOR, nil)
+	return r
+}
+
+//DefaultCodecs is the CodecRegistry used by LinkDecoder.
+var DefaultCodecs = NewCodecRegistry()
+
+//Register sets the decoder and optional size estimator of a multicodec, replacing any existing one.
+func (r *CodecRegistry) Register(codec uint64, decoder LinkDecoderFunc, size SizeEstimatorFunc) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.codecs[codec] = codecEntry{decoder: decoder, size: size}
+}
+
+//Unregister removes the decoder of a multicodec.
+func (r *CodecRegistry) Unregister(codec uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.codecs, codec)
+}
+
+//Supports returns true if the multicodec has a decoder.
+func (r *CodecRegistry) Supports(codec uint64) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	_, ok := r.codecs[codec]
+	return ok
+}
+
+//Decode is a LinkDecoderFunc, it returns CodecNotSupportedError for unregistered codecs.
+func (r *CodecRegistry) Decode(id cid.Cid, data []byte) ([]cid.Cid, uint64, error) {
+	r.lock.RLock()
+	e, ok := r.codecs[id.Prefix().GetCodec()]
+	r.lock.RUnlock()
+	if !ok {
+		return nil, 0, &CodecNotSupportedError{Cid: id}
+	}
+	links, size, err := e.decoder(id, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if size == 0 && e.size != nil {
+		size = e.size(id, data, links)
+	}
+	return links, size, nil
+}
+
 //LinkDecoder is the default function for DatabaseOptions.LinkDecoder.
-//It decodes the required links for some common codecs.
+//It decodes the required links with the codecs in DefaultCodecs.
 //Total size returned is zero if not decodable.
 func LinkDecoder(id cid.Cid, data []byte) ([]cid.Cid, uint64, error) {
-	switch id.Prefix().GetCodec() {
-	default:
-		b, err := blocks.NewBlockWithCid(data, id)
-		if err != nil {
-			return nil, 0, err
-		}
-		node, err := ipld.DefaultBlockDecoder.Decode(b)
-		if err != nil {
-			return nil, 0, err
-		}
-		ls := node.Links()
-		out := make([]cid.Cid, len(ls))
-		for i, l := range ls {
-			if l == nil {
-				return nil, 0, errors.Errorf("block %v contains empty links %v", id, ls)
+	return DefaultCodecs.Decode(id, data)
+}
+
+func decodeRaw(id cid.Cid, data []byte) ([]cid.Cid, uint64, error) {
+	return nil, uint64(len(data)), nil
+}
+
+func decodeProtobuf(id cid.Cid, data []byte) ([]cid.Cid, uint64, error) {
+	pnode, err := merkledag.DecodeProtobuf(data)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	out, err := linksToCids(id, pnode.Links())
+	if err != nil {
+		return nil, 0, err
+	}
+	size, _ := pnode.Size()
+	return out, size, nil
+}
+
+//decodeCBOR decodes dag-cbor, and dag-jose which is a dag-cbor encoding of JOSE objects.
+//The size returned is only the size of the block itself.
+func decodeCBOR(id cid.Cid, data []byte) ([]cid.Cid, uint64, error) {
+	var v interface{}
+	if err := cbornode.DecodeInto(data, &v); err != nil {
+		return nil, 0, errors.Wrapf(err, "decoding dag-cbor block %v", id)
+	}
+	var out []cid.Cid
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case cid.Cid:
+			out = append(out, v)
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys) //keep links in a deterministic order, like dag-json
+			for _, k := range keys {
+				walk(v[k])
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
 			}
-			out[i] = l.Cid
-		}
-		size, _ := node.Size()
-		return out, size, nil
-	case cid.Raw:
-		return nil, uint64(len(data)), nil
-	case cid.DagProtobuf:
-		pnode, err := merkledag.DecodeProtobuf(data)
-		if err != nil {
-			return nil, 0, errors.WithStack(err)
 		}
-		ls := pnode.Links()
-		out := make([]cid.Cid, len(ls))
-		for i, l := range ls {
-			if l == nil {
-				return nil, 0, errors.Errorf("block %v contains empty links %v", id, ls)
+	}
+	walk(v)
+	return out, uint64(len(data)), nil
+}
+
+//decodeJSON decodes dag-json, where links are maps with a single "/" key of a cid string.
+//The size returned is only the size of the block itself.
+func decodeJSON(id cid.Cid, data []byte) ([]cid.Cid, uint64, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, 0, errors.Wrapf(err, "decoding dag-json block %v", id)
+	}
+	var out []cid.Cid
+	var walk func(v interface{}) error
+	walk = func(v interface{}) error {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if s, ok := v["/"].(string); ok && len(v) == 1 {
+				link, err := cid.Decode(s)
+				if err != nil {
+					return errors.Wrapf(err, "block %v contains invalid link %q", id, s)
+				}
+				out = append(out, link)
+				return nil
+			}
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys) //keep links in a deterministic order
+			for _, k := range keys {
+				if err := walk(v[k]); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for _, e := range v {
+				if err := walk(e); err != nil {
+					return err
+				}
 			}
-			out[i] = l.Cid
 		}
-		size, _ := pnode.Size()
-		return out, size, nil
+		return nil
+	}
+	if err := walk(v); err != nil {
+		return nil, 0, err
+	}
+	return out, uint64(len(data)), nil
+}
+
+func linksToCids(id cid.Cid, ls []*ipld.Link) ([]cid.Cid, error) {
+	out := make([]cid.Cid, len(ls))
+	for i, l := range ls {
+		if l == nil {
+			return nil, errors.Errorf("block %v contains empty links %v", id, ls)
+		}
+		out[i] = l.Cid
 	}
+	return out, nil
 }
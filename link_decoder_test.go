@@ -0,0 +1,97 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+)
+
+func TestCodecRegistry(t *testing.T) {
+	cids, _ := setup(t)
+	links := []cid.Cid{cids[5], cids[4]}
+
+	cbor, err := cbornode.WrapObject(map[string]interface{}{
+		"a": links[0],
+		"b": []interface{}{links[1]},
+	}, multihash.SHA2_256, -1)
+	fatalIfErr(t, err)
+	jose := cid.NewCidV1(DagJOSE, cbor.Cid().Hash())
+	json := []byte(fmt.Sprintf(`{"b":[{"/":%q}],"a":{"/":%q},"c":{"/":{"bytes":"AA"}}}`, links[1], links[0]))
+	jsonID, err := cid.V1Builder{Codec: DagJSON, MhType: multihash.SHA2_256}.Sum(json)
+	fatalIfErr(t, err)
+
+	for _, c := range []struct {
+		id   cid.Cid
+		data []byte
+	}{
+		{id: cbor.Cid(), data: cbor.RawData()},
+		{id: jose, data: cbor.RawData()},
+		{id: jsonID, data: json},
+	} {
+		got, size, err := LinkDecoder(c.id, c.data)
+		fatalIfErr(t, err)
+		if !reflect.DeepEqual(got, links) {
+			t.Errorf("expected links %v from %v, got %v", links, c.id, got)
+		}
+		if size != uint64(len(c.data)) {
+			t.Errorf("expected size %v from %v, got %v", len(c.data), c.id, size)
+		}
+	}
+
+	//links of maps are in key order whatever the map iteration order
+	many := make(map[string]interface{})
+	var want []cid.Cid
+	for i, id := range cids {
+		many[string(rune('a'+i))] = id
+		want = append(want, id)
+	}
+	manyCbor, err := cbornode.WrapObject(many, multihash.SHA2_256, -1)
+	fatalIfErr(t, err)
+	for i := 0; i < 10; i++ {
+		got, _, err := LinkDecoder(manyCbor.Cid(), manyCbor.RawData())
+		fatalIfErr(t, err)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected links %v in key order, got %v", want, got)
+		}
+	}
+
+	unknown := cid.NewCidV1(0x300001, cbor.Cid().Hash())
+	var notSupported *CodecNotSupportedError
+	if _, _, err := LinkDecoder(unknown, cbor.RawData()); !errors.As(err, &notSupported) {
+		t.Fatalf("expected CodecNotSupportedError, got %v", err)
+	}
+	r := NewCodecRegistry()
+	r.Register(unknown.Prefix().GetCodec(), decodeCBOR, func(id cid.Cid, data []byte, links []cid.Cid) uint64 {
+		return 42
+	})
+	got, size, err := r.Decode(unknown, cbor.RawData())
+	fatalIfErr(t, err)
+	if !reflect.DeepEqual(got, links) || size != uint64(len(cbor.RawData())) {
+		t.Errorf("unexpected decode result %v, %v", got, size)
+	}
+	r.Register(unknown.Prefix().GetCodec(), decodeRaw, func(id cid.Cid, data []byte, links []cid.Cid) uint64 {
+		return 42
+	})
+	if _, size, _ := r.Decode(unknown, nil); size != 42 {
+		t.Errorf("expected size from estimator, got %v", size)
+	}
+}
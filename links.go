@@ -0,0 +1,108 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"encoding/binary"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/pkg/errors"
+)
+
+var linksSuffixKey = datastore.NewKey("/l")
+
+//getLinksKey returns the key of the decoded link list of a stored block
+func (c *Counted) getLinksKey(id cid.Cid) datastore.Key {
+	return c.cidKey(id, linksSuffixKey)
+}
+
+//encodeLinks encodes a link list as: uvarint size, then a uvarint length prefixed binary cid per link.
+func encodeLinks(links []cid.Cid, size uint64) []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64*(len(links)+1)+len(links)*36)
+	buf = appendUvarint(buf, size)
+	for _, link := range links {
+		b := link.Bytes()
+		buf = appendUvarint(buf, uint64(len(b)))
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func decodeLinks(bs []byte) ([]cid.Cid, uint64, error) {
+	size, n := binary.Uvarint(bs)
+	if n <= 0 {
+		return nil, 0, errors.New("link list size can not be decoded")
+	}
+	bs = bs[n:]
+	var links []cid.Cid
+	for len(bs) > 0 {
+		l, n := binary.Uvarint(bs)
+		if n <= 0 || uint64(len(bs)-n) < l {
+			return nil, 0, errors.New("link list is truncated")
+		}
+		id, err := cid.Cast(bs[n : n+int(l)])
+		if err != nil {
+			return nil, 0, errors.WithStack(err)
+		}
+		links = append(links, id)
+		bs = bs[n+int(l):]
+	}
+	return links, size, nil
+}
+
+//setLinks saves the decoded links and logical size of a newly stored block
+func (c *Counted) setLinks(db datastore.Write, id cid.Cid, links []cid.Cid, size uint64) error {
+	return db.Put(c.getLinksKey(id), encodeLinks(links, size))
+}
+
+//storedLinks returns the links and logical size of a stored block from its link list.
+//Blocks stored before link lists were kept are decoded from their data.
+func (c *Counted) storedLinks(db datastore.Read, id cid.Cid) ([]cid.Cid, uint64, error) {
+	bs, err := db.Get(c.getLinksKey(id))
+	if err == nil {
+		links, size, err := decodeLinks(bs)
+		if err != nil {
+			return nil, 0, err
+		}
+		links, err = c.expandIdentity(c.normalizeAll(links))
+		return links, size, err
+	}
+	if err != datastore.ErrNotFound {
+		return nil, 0, err
+	}
+	data, err := c.getData(db, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	has, err := db.Has(c.getOpaqueKey(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	if has {
+		return nil, uint64(len(data)), nil
+	}
+	links, size, err := c.opt.LinkDecoder(id, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	links, err = c.expandIdentity(c.normalizeAll(links))
+	return links, size, err
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/pkg/errors"
+)
+
+func TestLinkList(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	for _, links := range [][]cid.Cid{nil, cids[:1], cids} {
+		got, size, err := decodeLinks(encodeLinks(links, 42))
+		fatalIfErr(t, err)
+		if !reflect.DeepEqual(got, links) || size != 42 {
+			t.Errorf("link list %v, %v decoded as %v, %v", links, 42, got, size)
+		}
+	}
+	if _, _, err := decodeLinks(encodeLinks(cids, 1)[:10]); err == nil {
+		t.Error("expected truncated link list to fail")
+	}
+
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	store, err := NewProgressiveCountedStore(db, nil)
+	fatalIfErr(t, err)
+	_, err = store.Increment(ctx, cids[0], getter)
+	fatalIfErr(t, err)
+	pm, _, err := store.ProgressiveIncrement(ctx, cids[1], getter)
+	fatalIfErr(t, err)
+	fatalIfErr(t, pm.Run(ctx))
+
+	//removal and reports only use the stored link lists
+	noDecoder, err := NewProgressiveCountedStore(db, &DatabaseOptions{
+		LinkDecoder: func(id cid.Cid, data []byte) ([]cid.Cid, uint64, error) {
+			return nil, 0, errors.New("decoder should not be used")
+		},
+	})
+	fatalIfErr(t, err)
+	var r ProgressReport
+	fatalIfErr(t, noDecoder.GetProgressReport(ctx, cids[1], &r))
+	if r.HaveBytes != r.KnownBytes || r.KnownBytes == 0 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	_, err = noDecoder.Decrement(ctx, cids[0])
+	fatalIfErr(t, err)
+	_, err = noDecoder.Decrement(ctx, cids[1])
+	fatalIfErr(t, err)
+	checkFullStoreByIterator(t, ctx, nil, noDecoder)
+	checkCounts(t, ctx, make([]int64, len(cids)), cids, noDecoder)
+}
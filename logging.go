@@ -0,0 +1,72 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"github.com/ipfs/go-cid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+//Log levels of the store:
+// Debug: commit conflicts and the recursion decisions of increment and decrement.
+// Info: deleted blocks and roots, and reverted progress.
+// Warn: transactions given up by RetryPolicy and blocks with links that fail to decode.
+// Error: corrupted counters.
+//Tags are never logged, since TagHashKey may be set to keep them private.
+
+//newLogger returns the logger of a store. Without a logger it is a no-op logger,
+// so disabled logging only costs a level check.
+func newLogger(l *zap.Logger, level zapcore.LevelEnabler) *zap.Logger {
+	if l == nil {
+		return zap.NewNop()
+	}
+	l = l.Named("sharedforeststore")
+	if level != nil {
+		l = l.WithOptions(zap.IncreaseLevel(level))
+	}
+	return l
+}
+
+//logs returns true if entries of the level are written, callers check it before building fields.
+func (c *Counted) logs(level zapcore.Level) bool {
+	return c.log.Core().Enabled(level)
+}
+
+func cidField(id cid.Cid) zap.Field {
+	return zap.Stringer("cid", id)
+}
+
+//pendingLog is a log entry written once its transaction is committed.
+type pendingLog struct {
+	level  zapcore.Level
+	msg    string
+	fields []zap.Field
+}
+
+//logOnCommit keeps a log entry until the transaction is committed,
+// so entries of attempts that are retried are dropped.
+func (c *Tx) logOnCommit(level zapcore.Level, msg string, fields ...zap.Field) {
+	c.pending = append(c.pending, pendingLog{level: level, msg: msg, fields: fields})
+}
+
+//writeLogs writes the log entries of a committed transaction.
+func (c *Tx) writeLogs() {
+	for _, l := range c.pending {
+		if ce := c.store.log.Check(l.level, l.msg); ce != nil {
+			ce.Write(l.fields...)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogging(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	tagA, tagB := datastore.NewKey("tagA"), datastore.NewKey("tagB")
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	store, err := NewTagCountedStore(db, &DatabaseOptions{Logger: zap.New(core)})
+	fatalIfErr(t, err)
+	fatalIfErr(t, store.PutTag(ctx, cids[0], tagA, getter))
+	fatalIfErr(t, store.PutTag(ctx, cids[1], tagB, getter))
+	//a, d, f, b and e are followed, d is already stored when b links to it
+	if n := logs.FilterMessage("following links").Len(); n != 5 {
+		t.Errorf("expected 5 followed blocks, got %v", n)
+	}
+	if n := logs.FilterMessage("block already stored, links not followed").FilterField(cidField(cids[3])).Len(); n != 1 {
+		t.Errorf("expected d not to be followed again, got %v", n)
+	}
+
+	fatalIfErr(t, store.RemoveTag(ctx, cids[0], tagA))
+	if n := logs.FilterMessage("block deleted").Len(); n != 1 {
+		t.Errorf("expected only a to be deleted, got %v", n)
+	}
+	if n := logs.FilterMessage("root deleted").FilterField(cidField(cids[0])).Len(); n != 1 {
+		t.Errorf("expected root a to be deleted, got %v", n)
+	}
+	for _, e := range logs.All() {
+		for _, f := range e.Context {
+			if f.String == tagA.String() || f.String == tagB.String() {
+				t.Errorf("tag logged in %q", e.Message)
+			}
+		}
+	}
+
+	//a corrupted counter is logged and returned with its cid
+	fatalIfErr(t, db.Put(datastore.Key(store.getCounterKey(cids[1])), []byte{0}))
+	if _, err := store.GetCount(ctx, cids[1]); err == nil || !strings.Contains(err.Error(), cids[1].String()) {
+		t.Errorf("expected corrupted counter error with the cid, got %v", err)
+	}
+	if n := logs.FilterMessage("corrupted counter").FilterField(cidField(cids[1])).Len(); n != 1 {
+		t.Errorf("expected the corrupted counter to be logged, got %v", n)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	store, err := NewTagCountedStore(db, &DatabaseOptions{Logger: zap.New(core), LogLevel: zapcore.InfoLevel})
+	fatalIfErr(t, err)
+	if store.logs(zapcore.DebugLevel) || !store.logs(zapcore.InfoLevel) {
+		t.Fatal("expected LogLevel to raise the level of Logger")
+	}
+	fatalIfErr(t, store.PutTag(ctx, cids[0], datastore.NewKey("tag"), getter))
+	fatalIfErr(t, store.RemoveTag(ctx, cids[0], datastore.NewKey("tag")))
+	if n := logs.FilterMessage("following links").Len(); n != 0 {
+		t.Errorf("expected no debug entries, got %v", n)
+	}
+	if n := logs.FilterMessage("block deleted").Len(); n != 3 {
+		t.Errorf("expected 3 deleted blocks, got %v", n)
+	}
+
+	//without a logger nothing is enabled
+	store, err = NewTagCountedStore(db, nil)
+	fatalIfErr(t, err)
+	if store.logs(zapcore.ErrorLevel) {
+		t.Error("expected logging to be disabled without Logger")
+	}
+}
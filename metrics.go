@@ -0,0 +1,105 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"time"
+
+	"github.com/ipfs/go-metrics-interface"
+)
+
+//DefaultMetricsScope is the scope of metrics if DatabaseOptions.MetricsScope is empty.
+const DefaultMetricsScope = "sharedforeststore"
+
+//latencyBuckets are the upper bounds in seconds of the latency histograms, from 100µs to about 26s.
+var latencyBuckets = []float64{0.0001, 0.0004, 0.0016, 0.0064, 0.0256, 0.1024, 0.4096, 1.6384, 6.5536, 26.2144}
+
+//storeMetrics are the metrics of a store, they are created with go-metrics-interface
+// and do nothing unless an implementation such as go-metrics-prometheus is injected.
+type storeMetrics struct {
+	increment   metrics.Histogram
+	decrement   metrics.Histogram
+	putTag      metrics.Histogram
+	removeTag   metrics.Histogram
+	fetch       metrics.Histogram
+	commits     metrics.Counter
+	conflicts   metrics.Counter
+	aborts      metrics.Counter
+	stored      metrics.Counter
+	deleted     metrics.Counter
+	storedBytes metrics.Counter
+	inFlight    metrics.Gauge
+}
+
+//newStoreMetrics creates the metrics of a store under scope with create, which is metrics.New outside of tests.
+func newStoreMetrics(scope string, create func(name, helptext string) metrics.Creator) *storeMetrics {
+	if scope == "" {
+		scope = DefaultMetricsScope
+	}
+	histogram := func(name, help string) metrics.Histogram {
+		return create(scope+"."+name, help).Histogram(latencyBuckets)
+	}
+	counter := func(name, help string) metrics.Counter {
+		return create(scope+"."+name, help).Counter()
+	}
+	return &storeMetrics{
+		increment:   histogram("increment.latency.seconds", "Latency of Increment"),
+		decrement:   histogram("decrement.latency.seconds", "Latency of Decrement"),
+		putTag:      histogram("put_tag.latency.seconds", "Latency of PutTag"),
+		removeTag:   histogram("remove_tag.latency.seconds", "Latency of RemoveTag"),
+		fetch:       histogram("block_getter.latency.seconds", "Latency of fetching blocks from BlockGetter"),
+		commits:     counter("tx.commits.total", "Number of committed transactions"),
+		conflicts:   counter("tx.conflicts.total", "Number of failed commits, each one is followed by a retry or an abort"),
+		aborts:      counter("tx.aborts.total", "Number of transactions given up by RetryPolicy"),
+		stored:      counter("blocks.stored.total", "Number of blocks stored"),
+		deleted:     counter("blocks.deleted.total", "Number of blocks deleted"),
+		storedBytes: counter("blocks.stored.bytes", "Size of the blocks stored"),
+		inFlight:    create(scope+".progressive.in_flight", "Number of running progressive uploads").Gauge(),
+	}
+}
+
+//observeSince adds the time since start to h, it is meant to be deferred.
+func observeSince(h metrics.Histogram, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+//txMetrics are the changes of a transaction, they are added to the metrics once it is committed.
+type txMetrics struct {
+	stored      uint64
+	deleted     uint64
+	storedBytes uint64
+}
+
+func (m *txMetrics) add(ch Change) {
+	switch ch.Kind {
+	case ChangeBlockStored:
+		m.stored++
+	case ChangeBlockDeleted:
+		m.deleted++
+	}
+}
+
+//observeCommit updates the metrics with the changes of a committed transaction.
+func (c *Tx) observeCommit() {
+	m := c.store.metrics
+	m.commits.Inc()
+	if c.changed.stored > 0 {
+		m.stored.Add(float64(c.changed.stored))
+		m.storedBytes.Add(float64(c.changed.storedBytes))
+	}
+	if c.changed.deleted > 0 {
+		m.deleted.Add(float64(c.changed.deleted))
+	}
+}
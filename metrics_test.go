@@ -0,0 +1,141 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/ipfs/go-metrics-interface"
+)
+
+//recordedMetrics implements the metrics of go-metrics-interface by recording values by name.
+type recordedMetrics struct {
+	sync.Mutex
+	names        []string
+	values       map[string]float64
+	observations map[string]int
+}
+
+type recordedMetric struct {
+	r    *recordedMetrics
+	name string
+}
+
+func (m recordedMetric) Inc()          { m.Add(1) }
+func (m recordedMetric) Dec()          { m.Add(-1) }
+func (m recordedMetric) Sub(v float64) { m.Add(-v) }
+
+func (m recordedMetric) Set(v float64) {
+	m.r.Lock()
+	defer m.r.Unlock()
+	m.r.values[m.name] = v
+}
+
+func (m recordedMetric) Add(v float64) {
+	m.r.Lock()
+	defer m.r.Unlock()
+	m.r.values[m.name] += v
+}
+
+func (m recordedMetric) Observe(v float64) {
+	m.r.Lock()
+	defer m.r.Unlock()
+	m.r.observations[m.name]++
+}
+
+func (m recordedMetric) Counter() metrics.Counter                         { return m }
+func (m recordedMetric) Gauge() metrics.Gauge                             { return m }
+func (m recordedMetric) Histogram(buckets []float64) metrics.Histogram    { return m }
+func (m recordedMetric) Summary(opts metrics.SummaryOpts) metrics.Summary { return m }
+
+func (r *recordedMetrics) create(name, helptext string) metrics.Creator {
+	r.names = append(r.names, name)
+	return recordedMetric{r: r, name: name}
+}
+
+func (r *recordedMetrics) value(name string) float64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.values["test."+name]
+}
+
+func (r *recordedMetrics) count(name string) int {
+	r.Lock()
+	defer r.Unlock()
+	return r.observations["test."+name]
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	tagA, tagB := datastore.NewKey("tagA"), datastore.NewKey("tagB")
+
+	store, err := NewProgressiveTagCountedStore(db, nil)
+	fatalIfErr(t, err)
+	r := &recordedMetrics{values: make(map[string]float64), observations: make(map[string]int)}
+	store.metrics = newStoreMetrics("test", r.create)
+	for _, name := range r.names {
+		if !strings.HasPrefix(name, "test.") {
+			t.Errorf("metric %v is not in the scope", name)
+		}
+	}
+
+	fatalIfErr(t, store.PutTag(ctx, cids[0], tagA, getter))
+	fatalIfErr(t, store.ProgressivePutTag(ctx, cids[1], tagB, getter).Run(ctx))
+	var size float64
+	for _, i := range []int{0, 1, 3, 4, 5} {
+		data, err := getter.GetBlock(ctx, cids[i])
+		fatalIfErr(t, err)
+		size += float64(len(data))
+	}
+	if v := r.value("blocks.stored.total"); v != 5 {
+		t.Errorf("expected 5 blocks stored, got %v", v)
+	}
+	if v := r.value("blocks.stored.bytes"); v != size {
+		t.Errorf("expected %v bytes stored, got %v", size, v)
+	}
+	if n := r.count("block_getter.latency.seconds"); n != 5 {
+		t.Errorf("expected 5 fetches, got %v", n)
+	}
+	if v := r.value("progressive.in_flight"); v != 0 {
+		t.Errorf("expected no progressive upload in flight, got %v", v)
+	}
+
+	fatalIfErr(t, store.RemoveTag(ctx, cids[0], tagA))
+	fatalIfErr(t, store.RemoveTag(ctx, cids[1], tagB))
+	if v := r.value("blocks.deleted.total"); v != 5 {
+		t.Errorf("expected 5 blocks deleted, got %v", v)
+	}
+	if n := r.count("put_tag.latency.seconds"); n != 1 {
+		t.Errorf("expected 1 PutTag latency, got %v", n)
+	}
+	if n := r.count("remove_tag.latency.seconds"); n != 2 {
+		t.Errorf("expected 2 RemoveTag latencies, got %v", n)
+	}
+	//the schema was written before the metrics were replaced
+	if v, want := r.value("tx.commits.total"), float64(store.TxStats().Commits-1); v != want {
+		t.Errorf("expected %v commits, got %v", want, v)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/pkg/errors"
+)
+
+//CodecPolicy decides how blocks with codecs not supported by LinkDecoder are stored.
+type CodecPolicy uint8
+
+const (
+	//CodecReject fails the put with CodecNotSupportedError, this is the default.
+	CodecReject CodecPolicy = iota
+	//CodecLeaf stores the block as an opaque leaf without links.
+	//Use Redecode with includeLeaves to follow its links once a decoder is available.
+	CodecLeaf
+	//CodecFlag stores the block as an opaque leaf and flags it for Redecode.
+	CodecFlag
+)
+
+//opaque marker values
+const (
+	opaqueLeaf    = 0
+	opaqueFlagged = 1
+)
+
+//decodeNew returns the links of newly stored data without writing them.
+//Blocks with unsupported codecs are opaque leaves according to the CodecPolicy, their marker is returned
+// for saveDecoded.
+func (c *Counted) decodeNew(id cid.Cid, data []byte) ([]cid.Cid, uint64, []byte, error) {
+	links, size, err := c.opt.LinkDecoder(id, data)
+	var notSupported *CodecNotSupportedError
+	var marker []byte
+	if err != nil {
+		if c.opt.UnknownCodecPolicy == CodecReject || !errors.As(err, &notSupported) {
+			return nil, 0, nil, err
+		}
+		marker = []byte{opaqueLeaf}
+		if c.opt.UnknownCodecPolicy == CodecFlag {
+			marker[0] = opaqueFlagged
+		}
+		links, size = nil, uint64(len(data))
+	}
+	if links, err = c.expandIdentity(c.normalizeAll(links)); err != nil {
+		return nil, 0, nil, err
+	}
+	return links, size, marker, nil
+}
+
+//saveDecoded saves the result of decodeNew as the link list of id.
+func (c *Tx) saveDecoded(id cid.Cid, links []cid.Cid, size uint64, marker []byte) error {
+	if marker != nil {
+		if err := c.transaction.Put(c.store.getOpaqueKey(id), marker); err != nil {
+			return err
+		}
+	}
+	return c.store.setLinks(c.transaction, id, links, size)
+}
+
+//deleteOpaque removes the opaque marker of deleted data
+func (c *Counted) deleteOpaque(db datastore.Write, id cid.Cid) error {
+	return db.Delete(c.getOpaqueKey(id))
+}
+
+//Redecode follows the links of blocks stored as opaque leaves by CodecFlag, or also by CodecLeaf if
+// includeLeaves is true, once LinkDecoder supports their codec. The linked blocks are counted as if the
+// block was just stored, missing blocks are requested from BlockGetter.
+//It returns the number of blocks decoded, blocks that are still not supported are skipped.
+func (c *Counted) Redecode(ctx context.Context, bg BlockGetter, includeLeaves bool) (int, error) {
+	rs, err := c.ds.Query(query.Query{Prefix: c.keys.kindPrefix(opaqueSuffixKey), KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	es, err := rs.Rest()
+	if err != nil {
+		return 0, err
+	}
+	decoded := 0
+	for _, e := range es {
+		id, err := c.keyToCid(e.Key, opaqueSuffixKey)
+		if err != nil {
+			continue
+		}
+		var ok bool
+		if err := c.txWarp(ctx, func(tx *Tx) (err error) {
+			ok, err = tx.redecode(id, bg, includeLeaves)
+			return err
+		}); err != nil {
+			return decoded, err
+		}
+		if ok {
+			decoded++
+		}
+	}
+	return decoded, nil
+}
+
+func (c *Tx) redecode(id cid.Cid, bg BlockGetter, includeLeaves bool) (bool, error) {
+	marker, err := c.transaction.Get(c.store.getOpaqueKey(id))
+	if err == datastore.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(marker) != 1 || (marker[0] == opaqueLeaf && !includeLeaves) {
+		return false, nil
+	}
+	data, err := c.store.getData(c.transaction, id)
+	if err == datastore.ErrNotFound {
+		return false, c.store.deleteOpaque(c.transaction, id) //stale marker
+	}
+	if err != nil {
+		return false, err
+	}
+	links, size, err := c.store.opt.LinkDecoder(id, data)
+	var notSupported *CodecNotSupportedError
+	if errors.As(err, &notSupported) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if links, err = c.store.expandIdentity(c.store.normalizeAll(links)); err != nil {
+		return false, err
+	}
+	if err := c.store.deleteOpaque(c.transaction, id); err != nil {
+		return false, err
+	}
+	if err := c.store.setLinks(c.transaction, id, links, size); err != nil {
+		return false, err
+	}
+	for _, link := range links {
+		if _, err := c.increment(link, bg); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
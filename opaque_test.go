@@ -0,0 +1,86 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/pkg/errors"
+)
+
+func TestUnknownCodecPolicy(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	ctx := context.Background()
+
+	for _, policy := range []CodecPolicy{CodecReject, CodecLeaf, CodecFlag} {
+		db, err := leveldb.NewDatastore("", nil)
+		fatalIfErr(t, err)
+		defer db.Close()
+		codecs := NewCodecRegistry()
+		codecs.Unregister(cid.DagProtobuf)
+		store, err := NewCountedStore(db, &DatabaseOptions{
+			LinkDecoder:        codecs.Decode,
+			UnknownCodecPolicy: policy,
+		})
+		fatalIfErr(t, err)
+
+		_, err = store.Increment(ctx, cids[0], getter)
+		if policy == CodecReject {
+			var notSupported *CodecNotSupportedError
+			if !errors.As(err, &notSupported) {
+				t.Fatalf("expected CodecNotSupportedError, got %v", err)
+			}
+			checkCounts(t, ctx, []int64{0, 0, 0, 0, 0, 0}, cids, store)
+			continue
+		}
+		fatalIfErr(t, err)
+		checkCounts(t, ctx, []int64{1, 0, 0, 0, 0, 0}, cids, store)
+
+		//nothing changes while the codec is still unknown
+		n, err := store.Redecode(ctx, getter, true)
+		fatalIfErr(t, err)
+		if n != 0 {
+			t.Fatalf("expected no blocks redecoded, got %v", n)
+		}
+
+		codecs.Register(cid.DagProtobuf, decodeProtobuf, nil)
+		n, err = store.Redecode(ctx, getter, false)
+		fatalIfErr(t, err)
+		if policy == CodecLeaf {
+			if n != 0 {
+				t.Fatalf("expected leaves to be skipped, got %v", n)
+			}
+			n, err = store.Redecode(ctx, getter, true)
+			fatalIfErr(t, err)
+		}
+		if n != 1 {
+			t.Fatalf("expected 1 block redecoded, got %v", n)
+		}
+		checkCounts(t, ctx, []int64{1, 0, 0, 1, 0, 1}, cids, store)
+		checkFullStoreByIterator(t, ctx, []cid.Cid{cids[0], cids[3], cids[5]}, store)
+
+		_, err = store.Decrement(ctx, cids[0])
+		fatalIfErr(t, err)
+		checkFullStoreByIterator(t, ctx, nil, store)
+		if has, err := db.Has(store.getOpaqueKey(cids[0])); has || err != nil {
+			t.Fatalf("expected no opaque marker, got %v, %v", has, err)
+		}
+	}
+}
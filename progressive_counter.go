@@ -30,23 +30,39 @@ type ProgressiveCounted struct {
 var _ ProgressiveCounterStore = (*ProgressiveCounted)(nil)
 
 //NewProgressiveCountedStore creates a new ProgressiveCounted (implements ProgressiveCounterStore) from a transactional datastore.
-func NewProgressiveCountedStore(ds datastore.TxnDatastore, opt *DatabaseOptions) *ProgressiveCounted {
-	return &ProgressiveCounted{
-		Counted: *NewCountedStore(ds, opt),
+func NewProgressiveCountedStore(ds datastore.TxnDatastore, opt *DatabaseOptions) (*ProgressiveCounted, error) {
+	cs, err := NewCountedStore(ds, opt)
+	if err != nil {
+		return nil, err
 	}
+	return &ProgressiveCounted{
+		Counted: *cs,
+	}, nil
 }
 
 func (c *ProgressiveCounted) ProgressiveIncrement(ctx context.Context, id cid.Cid, bg BlockGetter) (ProgressManager, int64, error) {
+	id = c.normalize(id)
+	if isIdentity(id) {
+		var count int64
+		err := c.txWarp(ctx, func(tx *Tx) (err error) {
+			count, err = tx.progressiveIdentity(id)
+			return err
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		return c.undoIncrement(ctx, id, bg), count, nil
+	}
 	var count int64
 	var meta metadata
 	err := c.txWarp(ctx, func(tx *Tx) (err error) {
 		var key counterKey
-		count, meta, key, err = getCount(tx.transaction, id)
+		count, meta, key, err = c.getCount(tx.transaction, id)
 		if err != nil {
 			return err
 		}
 		count++
-		return setCount(tx.transaction, key, count, meta)
+		return tx.setCount(id, key, count, meta)
 	})
 	if err != nil {
 		return nil, 0, err
@@ -54,7 +70,15 @@ func (c *ProgressiveCounted) ProgressiveIncrement(ctx context.Context, id cid.Ci
 	if meta.Complete {
 		return nil, count, nil
 	}
-	return c.ProgressiveContinue(ctx, id, bg), count, nil
+	return c.undoIncrement(ctx, id, bg), count, nil
+}
+
+//undoIncrement continues a ProgressiveIncrement, which is decremented again if it exceeds the IngestLimits.
+func (c *ProgressiveCounted) undoIncrement(ctx context.Context, id cid.Cid, bg BlockGetter) ProgressManager {
+	return c.continueOrUndo(ctx, id, bg, func(tx *Tx) error {
+		_, err := tx.Decrement(id)
+		return err
+	})
 }
 
 var ErrProgressReverted = errors.New("progress was reverted by an other action")
@@ -66,6 +90,9 @@ type StoreProgressManager struct {
 	run        func(context.Context) error
 	report     ProgressReport
 	reportLock sync.RWMutex
+	ingest     ingestState //blocks fetched by run
+	//undo removes the put being continued, it runs in the transaction that exceeded the IngestLimits
+	undo func(tx *Tx) error
 }
 
 //ProgressCompleted is a typed nil of *StoreProgressManager to indicate there is no progress to track
@@ -99,16 +126,27 @@ func (m *StoreProgressManager) updateReport(f func(r *ProgressReport)) {
 }
 
 func (c *ProgressiveCounted) ProgressiveContinue(ctx context.Context, id cid.Cid, bg BlockGetter) ProgressManager {
-	m := &StoreProgressManager{}
-	var r func(id cid.Cid) error // r is called recursively
-	r = func(id cid.Cid) error {
+	return c.continueOrUndo(ctx, id, bg, nil)
+}
+
+//continueOrUndo is ProgressiveContinue with an optional undo for a run that exceeds the IngestLimits.
+func (c *ProgressiveCounted) continueOrUndo(ctx context.Context, id cid.Cid, bg BlockGetter, undo func(tx *Tx) error) ProgressManager {
+	if id = c.normalize(id); isIdentity(id) {
+		return c.continueIdentity(ctx, id, bg, undo)
+	}
+	m := &StoreProgressManager{
+		ingest: ingestState{limits: c.opt.IngestLimits},
+		undo:   undo,
+	}
+	var r func(path []cid.Cid) error // r is called recursively
+	r = func(path []cid.Cid) error {
 		for {
-			cids, err := c.progressTx(ctx, id, bg, m)
+			cids, err := c.progressTx(ctx, path, bg, m)
 			if len(cids) == 0 || err != nil {
 				return err
 			}
 			for _, id := range cids {
-				if err := r(id); err != nil {
+				if err := r(append(path, id)); err != nil {
 					return err
 				}
 			}
@@ -116,81 +154,127 @@ func (c *ProgressiveCounted) ProgressiveContinue(ctx context.Context, id cid.Cid
 	}
 	m.run = func(ctx2 context.Context) error {
 		ctx = ctx2
-		return r(id)
+		c.metrics.inFlight.Inc()
+		defer c.metrics.inFlight.Dec()
+		return r([]cid.Cid{id})
 	}
 	return m
 }
 
-func (c *ProgressiveCounted) progressTx(ctx context.Context, id cid.Cid, bg BlockGetter, m *StoreProgressManager) ([]cid.Cid, error) {
+//progressTx stores the last cid in path and increments its direct links in a single transaction.
+//The aggregated progress of the cid is recomputed from its links and the change is added to
+//all its ancestors in path, so progress reports of the root are up to date without walking the DAG.
+//Other partially stored parents of a shared block are not updated, since parents are not indexed,
+// their progress is recomputed when they continue.
+//If the block exceeds the IngestLimits, nothing of it is written and the undo of m runs instead.
+func (c *ProgressiveCounted) progressTx(ctx context.Context, path []cid.Cid, bg BlockGetter, m *StoreProgressManager) ([]cid.Cid, error) {
+	id := path[len(path)-1]
+	span, ctx := startCidSpan(ctx, "progressTx", id, len(path)-1)
 	var cids []cid.Cid
 	var size uint64
-	err := c.txWarp(ctx, func(tx *Tx) error {
-		count, meta, key, err := getCount(tx.transaction, id)
+	var root metadata
+	var haveRoot bool
+	var ingest ingestState
+	step := func(tx *Tx) (err error) {
+		haveRoot = false
+		tx.ingest = m.ingest
+		defer func() {
+			ingest = tx.ingest
+		}()
+		count, meta, key, err := c.getCount(tx.transaction, id)
 		if err != nil {
 			return err
 		}
 		if count == 0 {
+			c.log.Info("progress reverted", cidField(id))
 			return ErrProgressReverted
 		}
 		if meta.Complete {
 			cids = nil
 			return nil
 		}
-		getter := bg
+		var allLinks []cid.Cid
+		stored := meta
 		if meta.HavePart {
-			getter = c
+			allLinks, size, err = c.storedLinks(tx.transaction, id)
+		} else {
+			allLinks, size, stored, err = tx.storeBlock(id, bg)
 		}
-		data, err := getter.GetBlock(ctx, id)
 		if err != nil {
 			return err
 		}
-		if !meta.HavePart {
-			if err := tx.transaction.Put(getDataKey(id), data); err != nil {
-				return err
-			}
-		}
-		var allLinks []cid.Cid
-		if allLinks, size, err = c.opt.LinkDecoder(id, data); err != nil {
-			return err
-		}
 		if cids == nil {
 			cids = make([]cid.Cid, 0, len(allLinks))
 		} else {
 			cids = cids[:0]
 		}
 		increment := !meta.HavePart
+		var haveBytes uint64
 		for _, link := range allLinks {
 			if ctx.Err() != nil {
 				return ctx.Err()
 			}
-			count, meta, key, err := getCount(tx.transaction, link)
+			count, meta, key, err := c.getCount(tx.transaction, link)
 			if err != nil {
 				return err
 			}
 			if increment {
 				count++
-				if err := setCount(tx.transaction, key, count, meta); err != nil {
+				if err := tx.setCount(link, key, count, meta); err != nil {
 					return err
 				}
 			}
 			if !meta.Complete {
 				cids = append(cids, link)
+				haveBytes += meta.HaveBytes
+				continue
 			}
-		}
-		if len(cids) == 0 {
-			if err := setCount(tx.transaction, key, count, metadata{Complete: true, HavePart: true}); err != nil {
-				return err
-			}
-		} else if !meta.HavePart {
-			if err := setCount(tx.transaction, key, count, metadata{Complete: false, HavePart: true}); err != nil {
+			n, err := c.completedSize(tx.transaction, link)
+			if err != nil {
 				return err
 			}
+			haveBytes += n
 		}
-		return nil
+		next := metadata{HavePart: true, HaveBytes: haveBytes, HaveBlocks: meta.HaveBlocks}.withBlock(stored)
+		if increment {
+			next.HaveBlocks++
+		}
+		if len(cids) == 0 {
+			next = metadata{Complete: true, HavePart: true}.withBlock(stored)
+			haveBytes = size
+		}
+		if err := setCount(tx.transaction, key, count, next); err != nil {
+			return err
+		}
+		if len(path) == 1 {
+			root, haveRoot = next, true
+			return nil
+		}
+		var addBlocks uint64
+		if increment {
+			addBlocks = 1
+		}
+		root, haveRoot, err = c.addProgress(tx.transaction, path[:len(path)-1], int64(haveBytes)-int64(meta.HaveBytes), addBlocks)
+		return err
+	}
+	var limited *IngestLimitError
+	err := c.txWarp(ctx, func(tx *Tx) error {
+		limited = nil
+		err := step(tx)
+		if m.undo == nil || !errors.As(err, &limited) {
+			return err
+		}
+		cids, haveRoot = nil, false
+		return m.undo(tx)
 	})
+	if err == nil && limited != nil {
+		err = limited
+	}
+	finishSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
+	m.ingest = ingest
 	m.updateReport(func(r *ProgressReport) {
 		if !r.initalized {
 			r.initalized = true
@@ -198,61 +282,91 @@ func (c *ProgressiveCounted) progressTx(ctx context.Context, id cid.Cid, bg Bloc
 				r.KnownBytes = size
 			}
 		}
-		if len(cids) == 0 {
-			r.HaveBytes = size
+		if !haveRoot {
+			return
+		}
+		if root.Complete {
+			r.HaveBytes = r.KnownBytes
+			return
 		}
+		r.HaveBytes = root.HaveBytes
+		r.HaveBlocks = root.HaveBlocks
 	})
 	return cids, nil
 }
 
+//addProgress adds the progress made on a descendant to all its partially stored ancestors.
+//It returns the updated metadata of the first ancestor, if it was reached.
+func (c *Counted) addProgress(db readWriteStore, ancestors []cid.Cid, bytes int64, blocks uint64) (metadata, bool, error) {
+	var meta metadata
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		var count int64
+		var key counterKey
+		var err error
+		count, meta, key, err = c.getCount(db, ancestors[i])
+		if err != nil {
+			return metadata{}, false, err
+		}
+		if count == 0 || meta.Complete || !meta.HavePart {
+			//the rest of the ancestors are recomputed when they continue
+			return metadata{}, false, nil
+		}
+		if bytes < 0 && uint64(-bytes) > meta.HaveBytes {
+			meta.HaveBytes = 0
+		} else {
+			meta.HaveBytes = uint64(int64(meta.HaveBytes) + bytes)
+		}
+		meta.HaveBlocks += blocks
+		if err := setCount(db, key, count, meta); err != nil {
+			return metadata{}, false, err
+		}
+	}
+	return meta, true, nil
+}
+
+//completedSize returns the total size of a completely stored cid.
+func (c *Counted) completedSize(db datastore.Read, id cid.Cid) (uint64, error) {
+	_, size, err := c.storedLinks(db, id)
+	return size, err
+}
+
 var ErrSizeNotSupported = errors.New("size not supported")
 
+//GetProgressReport reports the progress for a cid from its stored metadata without walking the DAG.
+//The progress of a partially stored cid only includes blocks stored through it, blocks it shares with
+// another DAG that were stored by that DAG are included once the cid continues.
 func (c *ProgressiveCounted) GetProgressReport(ctx context.Context, id cid.Cid, r *ProgressReport) error {
 	*r = ProgressReport{initalized: true} //reset
-	data, err := c.GetBlock(ctx, id)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	id = c.normalize(id)
+	if isIdentity(id) {
+		return c.identityProgressReport(ctx, id, r)
+	}
+	_, meta, _, err := c.getCount(c.ds, id)
 	if err != nil {
-		if err == datastore.ErrNotFound {
-			return nil //block not found reports zero progress
-		}
 		return err
 	}
-	_, size, err := c.opt.LinkDecoder(id, data)
+	if !meta.HavePart {
+		return nil //block not found reports zero progress
+	}
+	_, size, err := c.storedLinks(c.ds, id)
 	if err != nil {
+		if err == datastore.ErrNotFound {
+			return nil //block was removed after the counter was read
+		}
 		return err
 	}
 	if size == 0 {
 		return ErrSizeNotSupported
 	}
 	r.KnownBytes = size
-
-	var sum func(cid.Cid) (uint64, error)
-	sum = func(id cid.Cid) (uint64, error) {
-		_, meta, _, err := getCount(c.ds, id)
-		if err != nil {
-			return 0, err
-		}
-		if !meta.HavePart {
-			return 0, nil
-		}
-		data, err := c.GetBlock(ctx, id)
-		if err != nil {
-			return 0, err
-		}
-		cids, size, err := c.opt.LinkDecoder(id, data)
-		if err != nil {
-			return 0, err
-		}
-		if meta.Complete {
-			return size, nil
-		} else {
-			size = 0
-			for _, id := range cids {
-				n, _ := sum(id) //ignore error here so we add as much as possible
-				size += n
-			}
-			return size, nil
-		}
+	if meta.Complete {
+		r.HaveBytes = size
+		return nil
 	}
-	r.HaveBytes, err = sum(id)
-	return err
+	r.HaveBytes = meta.HaveBytes
+	r.HaveBlocks = meta.HaveBlocks
+	return nil
 }
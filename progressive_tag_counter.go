@@ -30,11 +30,14 @@ type ProgressiveTagCounted struct {
 var _ ProgressiveTagCounterStore = (*ProgressiveTagCounted)(nil)
 
 //NewProgressiveTagCountedStore creates a new ProgressiveTagCounted from a transactional datastore.
-func NewProgressiveTagCountedStore(db datastore.TxnDatastore, opt *DatabaseOptions) *ProgressiveTagCounted {
-	cs := NewTagCountedStore(db, opt)
+func NewProgressiveTagCountedStore(db datastore.TxnDatastore, opt *DatabaseOptions) (*ProgressiveTagCounted, error) {
+	cs, err := NewTagCountedStore(db, opt)
+	if err != nil {
+		return nil, err
+	}
 	return &ProgressiveTagCounted{
 		TagCounted: *cs,
-	}
+	}, nil
 }
 
 func (c *ProgressiveTagCounted) ProgressiveIncrement(ctx context.Context, id cid.Cid, bg BlockGetter) (ProgressManager, int64, error) {
@@ -50,20 +53,26 @@ func (c *ProgressiveTagCounted) GetProgressReport(ctx context.Context, id cid.Ci
 }
 
 func (c *ProgressiveTagCounted) ProgressivePutTag(ctx context.Context, id cid.Cid, tag datastore.Key, bg BlockGetter) ProgressManager {
+	id = c.normalize(id)
 	var meta metadata
+	var put bool
 	err := c.txWarp(ctx, func(tx *Tx) (err error) {
-		put, err := txPutTag(tx.transaction, id, tag)
+		put, err = tx.putTag(id, tag)
 		if !put {
 			return err
 		}
+		if isIdentity(id) {
+			_, err = tx.progressiveIdentity(id)
+			return err
+		}
 		var count int64
 		var key counterKey
-		count, meta, key, err = getCount(tx.transaction, id)
+		count, meta, key, err = c.getCount(tx.transaction, id)
 		if err != nil {
 			return err
 		}
 		count++
-		return setCount(tx.transaction, key, count, meta)
+		return tx.setCount(id, key, count, meta)
 	})
 	if err != nil {
 		return &StoreProgressManager{err: err}
@@ -71,5 +80,11 @@ func (c *ProgressiveTagCounted) ProgressivePutTag(ctx context.Context, id cid.Ci
 	if meta.Complete {
 		return ProgressCompleted
 	}
-	return c.ProgressiveContinue(ctx, id, bg)
+	if !put {
+		//the tag was added by an earlier put, which is only continued
+		return c.ProgressiveContinue(ctx, id, bg)
+	}
+	return (&ProgressiveCounted{c.Counted}).continueOrUndo(ctx, id, bg, func(tx *Tx) error {
+		return tx.RemoveTag(id, tag)
+	})
 }
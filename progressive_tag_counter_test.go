@@ -31,7 +31,8 @@ func TestProgressiveTagCounter(t *testing.T) {
 	db, err := leveldb.NewDatastore("", nil)
 	fatalIfErr(t, err)
 	defer db.Close()
-	store := NewProgressiveTagCountedStore(db, nil)
+	store, err := NewProgressiveTagCountedStore(db, nil)
+	fatalIfErr(t, err)
 	ctx := context.Background()
 
 	var tagCases = []tagTestCase{
@@ -55,6 +56,9 @@ func TestProgressiveTagCounter(t *testing.T) {
 				if err != nil {
 					return err
 				}
+				if pm == nil {
+					pm = ProgressCompleted //already completed by another case
+				}
 				r := ProgressReport{}
 				if err := pm.CopyReport(&r); err != nil {
 					return err
@@ -123,7 +127,8 @@ func BenchmarkPutRemoveProgrisveTag(b *testing.B) {
 	db, err := leveldb.NewDatastore("", nil)
 	fatalIfErr(b, err)
 	defer db.Close()
-	store := NewProgressiveTagCountedStore(db, nil)
+	store, err := NewProgressiveTagCountedStore(db, nil)
+	fatalIfErr(b, err)
 	ctx := context.Background()
 	id := cids[1]
 	tag := datastore.NewKey("tag")
@@ -140,7 +145,8 @@ func BenchmarkPutRemoveProgressiveTag_P8(b *testing.B) {
 	db, err := leveldb.NewDatastore("", nil)
 	fatalIfErr(b, err)
 	defer db.Close()
-	store := NewProgressiveTagCountedStore(db, nil)
+	store, err := NewProgressiveTagCountedStore(db, nil)
+	fatalIfErr(b, err)
 	ctx := context.Background()
 	id := cids[1]
 	wg := sync.WaitGroup{}
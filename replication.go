@@ -0,0 +1,230 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+)
+
+//ReplicationSource is the primary store to replicate tags from.
+type ReplicationSource interface {
+	BlockGetter
+	HasTag(context.Context, cid.Cid, datastore.Key) (bool, error)
+	TagsIterator() TagIterator
+	Changes(fromSeq uint64) ChangeIterator
+	LastChangeSeq(context.Context) (uint64, error)
+}
+
+//ReplicationTarget is the replica store to replicate tags to.
+type ReplicationTarget interface {
+	TagStore
+	TagsIterator() TagIterator
+}
+
+var _ ReplicationSource = (*TagCounted)(nil)
+var _ ReplicationTarget = (*TagCounted)(nil)
+
+//ErrChangesTruncated is returned when changes not yet applied were truncated from the primary,
+// a full Sync is needed to recover.
+var ErrChangesTruncated = errors.New("changes to replicate were truncated")
+
+//ReplicationReport reports the divergence fixed by a replication.
+type ReplicationReport struct {
+	//Added is the number of tags put on the replica
+	Added int
+	//Removed is the number of tags removed from the replica
+	Removed int
+	//Lag is the number of primary changes not yet considered by the replica
+	Lag uint64
+}
+
+//Replicator makes the tags of a replica converge to the tags of a primary.
+//The primary is used as the BlockGetter, so only blocks missing from the replica are transferred.
+//A Replicator is not safe for concurrent use.
+type Replicator struct {
+	primary ReplicationSource
+	replica ReplicationTarget
+	//applied is the sequence number of the last primary change the replica is known to include
+	applied uint64
+}
+
+//NewReplicator creates a Replicator that continues from the primary change with sequence number
+// appliedSeq, use 0 and call Sync for a new replica.
+func NewReplicator(primary ReplicationSource, replica ReplicationTarget, appliedSeq uint64) *Replicator {
+	return &Replicator{
+		primary: primary,
+		replica: replica,
+		applied: appliedSeq,
+	}
+}
+
+//AppliedSeq returns the sequence number of the last primary change included in the replica.
+//It can be persisted to continue replication with NewReplicator.
+func (r *Replicator) AppliedSeq() uint64 {
+	return r.applied
+}
+
+//Lag returns the number of primary changes not yet considered by the replica.
+func (r *Replicator) Lag(ctx context.Context) (uint64, error) {
+	last, err := r.primary.LastChangeSeq(ctx)
+	if err != nil || last < r.applied {
+		return 0, err
+	}
+	return last - r.applied, nil
+}
+
+type tagRef struct {
+	id  string
+	tag string
+}
+
+//Sync compares all tags between the primary and replica and applies the differences to the replica.
+func (r *Replicator) Sync(ctx context.Context) (ReplicationReport, error) {
+	var report ReplicationReport
+	//changes after this point are replayed by Follow, which is safe since applying is idempotent
+	last, err := r.primary.LastChangeSeq(ctx)
+	if err != nil {
+		return report, err
+	}
+	extra := make(map[tagRef]struct{})
+	if err := forEachTag(ctx, r.replica.TagsIterator(), func(id cid.Cid, tag datastore.Key) error {
+		extra[tagRef{id: id.KeyString(), tag: tag.String()}] = struct{}{}
+		return nil
+	}); err != nil {
+		return report, err
+	}
+	if err := forEachTag(ctx, r.primary.TagsIterator(), func(id cid.Cid, tag datastore.Key) error {
+		ref := tagRef{id: id.KeyString(), tag: tag.String()}
+		if _, has := extra[ref]; has {
+			delete(extra, ref)
+			return nil
+		}
+		put, err := r.putTag(ctx, id, tag)
+		if put {
+			report.Added++
+		}
+		return err
+	}); err != nil {
+		return report, err
+	}
+	for ref := range extra {
+		id, err := cid.Cast([]byte(ref.id))
+		if err != nil {
+			return report, err
+		}
+		if err := r.replica.RemoveTag(ctx, id, datastore.RawKey(ref.tag)); err != nil {
+			return report, err
+		}
+		report.Removed++
+	}
+	r.applied = last
+	report.Lag, err = r.Lag(ctx)
+	return report, err
+}
+
+//Follow applies the primary changes made since the last Sync or Follow to the replica.
+func (r *Replicator) Follow(ctx context.Context) (report ReplicationReport, err error) {
+	it := r.primary.Changes(r.applied + 1)
+	defer func() {
+		err = multierr.Combine(err, it.Close())
+	}()
+	for {
+		ch, err := it.NextChange()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		if ch.Seq != r.applied+1 {
+			return report, errors.Wrapf(ErrChangesTruncated, "expected change %v, got %v", r.applied+1, ch.Seq)
+		}
+		added, removed, err := r.Apply(ctx, ch)
+		if err != nil {
+			return report, err
+		}
+		if added {
+			report.Added++
+		}
+		if removed {
+			report.Removed++
+		}
+		r.applied = ch.Seq
+	}
+	report.Lag, err = r.Lag(ctx)
+	return report, err
+}
+
+//Apply applies a tag change to the replica idempotently, other changes are ignored.
+//It returns if a tag was added to or removed from the replica.
+func (r *Replicator) Apply(ctx context.Context, ch Change) (added, removed bool, err error) {
+	switch ch.Kind {
+	case ChangeTagPut:
+		has, err := r.replica.HasTag(ctx, ch.Cid, ch.Tag)
+		if has || err != nil {
+			return false, false, err
+		}
+		put, err := r.putTag(ctx, ch.Cid, ch.Tag)
+		return put, false, err
+	case ChangeTagRemoved:
+		has, err := r.replica.HasTag(ctx, ch.Cid, ch.Tag)
+		if !has || err != nil {
+			return false, false, err
+		}
+		return false, true, r.replica.RemoveTag(ctx, ch.Cid, ch.Tag)
+	default:
+		return false, false, nil
+	}
+}
+
+//putTag puts a tag on the replica if it is still on the primary
+func (r *Replicator) putTag(ctx context.Context, id cid.Cid, tag datastore.Key) (bool, error) {
+	err := r.replica.PutTag(ctx, id, tag, r.primary)
+	if err == nil {
+		return true, nil
+	}
+	//blocks could have been removed with the tag from the primary, a later change removes the tag anyway
+	if has, err2 := r.primary.HasTag(ctx, id, tag); err2 == nil && !has {
+		return false, nil
+	}
+	return false, err
+}
+
+func forEachTag(ctx context.Context, it TagIterator, f func(cid.Cid, datastore.Key) error) (err error) {
+	defer func() {
+		err = multierr.Combine(err, it.Close())
+	}()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		id, tag, err := it.NextTag()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := f(id, tag); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/pkg/errors"
+)
+
+func TestReplicator(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	pdb, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer pdb.Close()
+	rdb, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer rdb.Close()
+	primary, err := NewTagCountedStore(pdb, &DatabaseOptions{ChangeLog: true})
+	fatalIfErr(t, err)
+	replica, err := NewTagCountedStore(rdb, nil)
+	fatalIfErr(t, err)
+	ctx := context.Background()
+	a, b := datastore.NewKey("A"), datastore.NewKey("B")
+
+	fatalIfErr(t, primary.PutTag(ctx, cids[0], a, getter))
+	fatalIfErr(t, primary.PutTag(ctx, cids[1], b, getter))
+	fatalIfErr(t, replica.PutTag(ctx, cids[2], a, getter))
+
+	r := NewReplicator(primary, replica, 0)
+	report, err := r.Sync(ctx)
+	fatalIfErr(t, err)
+	if report != (ReplicationReport{Added: 2, Removed: 1}) {
+		t.Errorf("unexpected report %+v", report)
+	}
+	checkCounts(t, ctx, []int64{1, 1, 0, 2, 1, 3}, cids, replica)
+	checkTags(t, ctx, cids[0], []string{"A"}, replica)
+	checkTags(t, ctx, cids[1], []string{"B"}, replica)
+
+	fatalIfErr(t, primary.PutTag(ctx, cids[2], b, getter))
+	fatalIfErr(t, primary.RemoveTag(ctx, cids[0], a))
+	//a tag added and removed before Follow is skipped
+	fatalIfErr(t, primary.PutTag(ctx, cids[0], b, getter))
+	fatalIfErr(t, primary.RemoveTag(ctx, cids[0], b))
+	lag, err := r.Lag(ctx)
+	fatalIfErr(t, err)
+	if lag == 0 {
+		t.Error("expected lag before Follow")
+	}
+	report, err = r.Follow(ctx)
+	fatalIfErr(t, err)
+	if report != (ReplicationReport{Added: 1, Removed: 1}) {
+		t.Errorf("unexpected report %+v", report)
+	}
+	checkCounts(t, ctx, []int64{0, 1, 1, 1, 2, 3}, cids, replica)
+	checkTags(t, ctx, cids[0], nil, replica)
+	checkTags(t, ctx, cids[2], []string{"B"}, replica)
+
+	//following again is a no-op
+	report, err = r.Follow(ctx)
+	fatalIfErr(t, err)
+	if report != (ReplicationReport{}) {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	fatalIfErr(t, primary.RemoveTag(ctx, cids[1], b))
+	fatalIfErr(t, primary.TruncateChanges(ctx, r.AppliedSeq()+2))
+	if _, err := r.Follow(ctx); !errors.Is(err, ErrChangesTruncated) {
+		t.Fatalf("expected ErrChangesTruncated, got %v", err)
+	}
+	report, err = r.Sync(ctx)
+	fatalIfErr(t, err)
+	if report != (ReplicationReport{Removed: 1}) {
+		t.Errorf("unexpected report %+v", report)
+	}
+	checkCounts(t, ctx, []int64{0, 0, 1, 0, 1, 2}, cids, replica)
+}
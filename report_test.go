@@ -26,7 +26,8 @@ func TestReport(t *testing.T) {
 	db, err := leveldb.NewDatastore("", nil)
 	fatalIfErr(t, err)
 	defer db.Close()
-	store := NewProgressiveTagCountedStore(db, nil)
+	store, err := NewProgressiveTagCountedStore(db, nil)
+	fatalIfErr(t, err)
 	ctx := context.Background()
 
 	expectedReports := []ProgressReport{
@@ -46,3 +47,93 @@ func TestReport(t *testing.T) {
 		t.Errorf("expected report %v, but got %v", expectedReports[1], *r)
 	}
 }
+
+func TestPartialReport(t *testing.T) {
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	store, err := NewProgressiveCountedStore(db, nil)
+	fatalIfErr(t, err)
+	ctx := context.Background()
+
+	//B links to D and E, without E only B, D and F can be stored
+	partial := make(mapBlockGetter)
+	for _, i := range []int{1, 3, 5} {
+		partial[cids[i]], err = getter.GetBlock(ctx, cids[i])
+		fatalIfErr(t, err)
+	}
+	sizeOf := func(i int) uint64 {
+		data, err := getter.GetBlock(ctx, cids[i])
+		fatalIfErr(t, err)
+		_, size, err := LinkDecoder(cids[i], data)
+		fatalIfErr(t, err)
+		return size
+	}
+
+	pm, _, err := store.ProgressiveIncrement(ctx, cids[1], partial)
+	fatalIfErr(t, err)
+	if err := pm.Run(ctx); err == nil {
+		t.Fatal("expected an error for the missing block")
+	}
+	expected := ProgressReport{initalized: true, HaveBytes: sizeOf(3), KnownBytes: sizeOf(1), HaveBlocks: 3}
+	r := &ProgressReport{}
+	fatalIfErr(t, pm.CopyReport(r))
+	if *r != expected {
+		t.Errorf("expected manager report %v, but got %v", expected, *r)
+	}
+	fatalIfErr(t, store.GetProgressReport(ctx, cids[1], r))
+	if *r != expected {
+		t.Errorf("expected report %v, but got %v", expected, *r)
+	}
+
+	fatalIfErr(t, store.ProgressiveContinue(ctx, cids[1], getter).Run(ctx))
+	expected = ProgressReport{initalized: true, HaveBytes: sizeOf(1), KnownBytes: sizeOf(1)}
+	fatalIfErr(t, store.GetProgressReport(ctx, cids[1], r))
+	if *r != expected {
+		t.Errorf("expected report %v, but got %v", expected, *r)
+	}
+	checkCounts(t, ctx, []int64{0, 1, 0, 1, 1, 3}, cids, store)
+}
+
+func TestSharedPartialReport(t *testing.T) {
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	store, err := NewProgressiveCountedStore(db, nil)
+	fatalIfErr(t, err)
+	ctx := context.Background()
+
+	//A is stored without D, which B shares with it
+	data, err := getter.GetBlock(ctx, cids[0])
+	fatalIfErr(t, err)
+	_, size, err := LinkDecoder(cids[0], data)
+	fatalIfErr(t, err)
+	pm, _, err := store.ProgressiveIncrement(ctx, cids[0], mapBlockGetter{cids[0]: data})
+	fatalIfErr(t, err)
+	if err := pm.Run(ctx); err == nil {
+		t.Fatal("expected an error for the missing block")
+	}
+	partial := ProgressReport{initalized: true, KnownBytes: size, HaveBlocks: 1}
+	r := &ProgressReport{}
+	fatalIfErr(t, store.GetProgressReport(ctx, cids[0], r))
+	if *r != partial {
+		t.Errorf("expected report %v, but got %v", partial, *r)
+	}
+
+	//D is stored through B, the report of A is path-local and only includes it once A continues
+	_, err = store.Increment(ctx, cids[1], getter)
+	fatalIfErr(t, err)
+	fatalIfErr(t, store.GetProgressReport(ctx, cids[0], r))
+	if *r != partial {
+		t.Errorf("expected report %v, but got %v", partial, *r)
+	}
+	fatalIfErr(t, store.ProgressiveContinue(ctx, cids[0], getter).Run(ctx))
+	complete := ProgressReport{initalized: true, HaveBytes: size, KnownBytes: size}
+	fatalIfErr(t, store.GetProgressReport(ctx, cids[0], r))
+	if *r != complete {
+		t.Errorf("expected report %v, but got %v", complete, *r)
+	}
+	checkCounts(t, ctx, []int64{1, 1, 0, 2, 1, 3}, cids, store)
+}
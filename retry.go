@@ -0,0 +1,147 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+//RetryPolicy decides if and when a transaction is retried after a failed commit.
+type RetryPolicy interface {
+	//Backoff returns the wait before retrying after the given number of failed commits,
+	// or false if the transaction should not be retried.
+	Backoff(failures int) (time.Duration, bool)
+}
+
+//ExponentialBackoff is a RetryPolicy that doubles the wait after each failed commit.
+type ExponentialBackoff struct {
+	//MaxAttempts is the maximum number of commits tried, 0 for unlimited.
+	MaxAttempts int
+	//Initial is the wait before the first retry.
+	Initial time.Duration
+	//Max caps the wait between retries, 0 for no cap.
+	Max time.Duration
+	//Jitter is the fraction of each wait, between 0 and 1, that is randomly removed
+	// to keep conflicting transactions from retrying in lock step.
+	Jitter float64
+}
+
+var _ RetryPolicy = ExponentialBackoff{}
+
+//DefaultRetryPolicy is the RetryPolicy of a store without one, it gives up with ErrTooManyConflicts
+// after 10 attempts, the jitter keeps conflicting writers from retrying in lock step.
+var DefaultRetryPolicy RetryPolicy = ExponentialBackoff{MaxAttempts: 10, Initial: time.Millisecond, Max: 100 * time.Millisecond, Jitter: 0.5}
+
+func (b ExponentialBackoff) Backoff(failures int) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && failures >= b.MaxAttempts {
+		return 0, false
+	}
+	wait := b.Initial
+	for i := 1; i < failures && wait < math.MaxInt64/2; i++ {
+		if b.Max > 0 && wait >= b.Max {
+			break
+		}
+		wait *= 2
+	}
+	if b.Max > 0 && wait > b.Max {
+		wait = b.Max
+	}
+	if b.Jitter > 0 {
+		wait -= time.Duration(rand.Float64() * math.Min(b.Jitter, 1) * float64(wait))
+	}
+	return wait, true
+}
+
+//ErrTooManyConflicts is matched by errors.Is for all TooManyConflictsError.
+var ErrTooManyConflicts = errors.New("too many commit conflicts")
+
+//TooManyConflictsError is returned when RetryPolicy stopped retrying a transaction.
+type TooManyConflictsError struct {
+	//Attempts is the number of failed commits
+	Attempts int
+	//Err is the last commit error
+	Err error
+}
+
+func (e *TooManyConflictsError) Error() string {
+	return fmt.Sprintf("%v: gave up after %v attempts, last error: %v", ErrTooManyConflicts, e.Attempts, e.Err)
+}
+
+func (e *TooManyConflictsError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TooManyConflictsError) Is(target error) bool {
+	return target == ErrTooManyConflicts
+}
+
+//TxStats are the transaction counters of a store since it was created.
+type TxStats struct {
+	//Commits is the number of successful commits
+	Commits uint64
+	//Conflicts is the number of failed commits, each one is followed by a retry or an abort
+	Conflicts uint64
+	//Aborts is the number of transactions given up by RetryPolicy
+	Aborts uint64
+}
+
+type txStats struct {
+	commits   uint64
+	conflicts uint64
+	aborts    uint64
+}
+
+//TxStats returns the transaction counters, they can be used to monitor contention.
+func (c *Counted) TxStats() TxStats {
+	return TxStats{
+		Commits:   atomic.LoadUint64(&c.stats.commits),
+		Conflicts: atomic.LoadUint64(&c.stats.conflicts),
+		Aborts:    atomic.LoadUint64(&c.stats.aborts),
+	}
+}
+
+//backoff waits before the next retry, or returns an error if the transaction should not be retried.
+func (c *Counted) backoff(ctx context.Context, failures int, commitError error) error {
+	if c.opt.RetryPolicy == nil {
+		return nil
+	}
+	wait, retry := c.opt.RetryPolicy.Backoff(failures)
+	if !retry {
+		atomic.AddUint64(&c.stats.aborts, 1)
+		c.metrics.aborts.Inc()
+		c.log.Warn("transaction given up after commit conflicts", zap.Int("attempts", failures), zap.Error(commitError))
+		return &TooManyConflictsError{Attempts: failures, Err: commitError}
+	}
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return multierr.Combine(ctx.Err(), commitError)
+	case <-timer.C:
+		return nil
+	}
+}
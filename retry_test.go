@@ -0,0 +1,125 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/pkg/errors"
+)
+
+var errTestConflict = errors.New("test conflict")
+
+//conflictDatastore fails the next n commits to simulate conflicts
+type conflictDatastore struct {
+	*leveldb.Datastore
+	n int32
+}
+
+type conflictTxn struct {
+	datastore.Txn
+	db *conflictDatastore
+}
+
+func (d *conflictDatastore) NewTransaction(readOnly bool) (datastore.Txn, error) {
+	tx, err := d.Datastore.NewTransaction(readOnly)
+	return &conflictTxn{Txn: tx, db: d}, err
+}
+
+func (t *conflictTxn) Commit() error {
+	if atomic.AddInt32(&t.db.n, -1) >= 0 {
+		return errTestConflict
+	}
+	return t.Txn.Commit()
+}
+
+func newConflictDatastore(t testing.TB, n int32) *conflictDatastore {
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	//the schema is written first, so the conflicts are left to the transactions of the test
+	_, err = NewCountedStore(db, nil)
+	fatalIfErr(t, err)
+	return &conflictDatastore{Datastore: db, n: n}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff{MaxAttempts: 5, Initial: time.Millisecond, Max: 5 * time.Millisecond}
+	for i, exp := range []time.Duration{1, 2, 4, 5} {
+		wait, retry := b.Backoff(i + 1)
+		if !retry || wait != exp*time.Millisecond {
+			t.Errorf("failure %v: got wait %v retry %v, expected %v", i+1, wait, retry, exp*time.Millisecond)
+		}
+	}
+	if _, retry := b.Backoff(5); retry {
+		t.Error("expected no retry after MaxAttempts")
+	}
+	b.Jitter = 0.5
+	for i := 1; i < 5; i++ {
+		exp, _ := ExponentialBackoff{Initial: b.Initial, Max: b.Max}.Backoff(i)
+		if wait, _ := b.Backoff(i); wait > exp || wait < exp/2 {
+			t.Errorf("wait %v is out of jitter range of %v", wait, exp)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	cids, getter := setup(t)
+	ctx := context.Background()
+
+	db := newConflictDatastore(t, 2)
+	defer db.Close()
+	store, err := NewCountedStore(db, &DatabaseOptions{
+		RetryPolicy: ExponentialBackoff{MaxAttempts: 3, Initial: time.Millisecond},
+	})
+	fatalIfErr(t, err)
+	_, err = store.Increment(ctx, cids[0], getter)
+	fatalIfErr(t, err)
+	checkCounts(t, ctx, []int64{1, 0, 0, 1, 0, 1}, cids, store)
+	if s := store.TxStats(); s != (TxStats{Commits: 1, Conflicts: 2}) {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	atomic.StoreInt32(&db.n, 3)
+	_, err = store.Increment(ctx, cids[1], getter)
+	if !errors.Is(err, ErrTooManyConflicts) || !errors.Is(err, errTestConflict) {
+		t.Fatalf("expected too many conflicts error, got %v", err)
+	}
+	checkCounts(t, ctx, []int64{1, 0, 0, 1, 0, 1}, cids, store)
+	if s := store.TxStats(); s != (TxStats{Commits: 1, Conflicts: 5, Aborts: 1}) {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	cids, getter := setup(t)
+	ctx := context.Background()
+
+	db := newConflictDatastore(t, 100)
+	defer db.Close()
+	store, err := NewCountedStore(db, nil)
+	fatalIfErr(t, err)
+	_, err = store.Increment(ctx, cids[0], getter)
+	if !errors.Is(err, ErrTooManyConflicts) {
+		t.Fatalf("expected too many conflicts error, got %v", err)
+	}
+	if s := store.TxStats(); s != (TxStats{Conflicts: 10, Aborts: 1}) {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/pkg/errors"
+)
+
+//SchemaVersion is the on-disk schema version written by this package.
+//Schema versions:
+// 0: stores written before the schema was versioned, counters may not have block sizes.
+// 1: all counters of stored blocks have their block size.
+// 2: all stored data starts with a data header.
+const SchemaVersion = 2
+
+var schemaKey = datastore.NewKey("/schema")
+
+var ErrSchemaTooNew = errors.New("store was written by a newer schema version")
+var ErrLayoutMismatch = errors.New("store was written with another KeyLayout")
+var ErrKeyEncodingMismatch = errors.New("store was written with another KeyEncoding")
+var ErrMigrationInProgress = errors.New("store is being migrated to another KeyLayout or KeyEncoding")
+
+//schema is the version record of a store.
+type schema struct {
+	Version uint64
+	//Layout is the KeyLayout data is written with, it changes once MigrateToMultihash completes.
+	Layout KeyLayout
+	//Encoding is the KeyEncoding of keys, it changes once MigrateKeyEncoding completes.
+	Encoding KeyEncoding
+	//Migrating is set while MigrateToMultihash or MigrateKeyEncoding converts the store
+	// to NextLayout and NextEncoding.
+	Migrating    bool
+	NextLayout   KeyLayout
+	NextEncoding KeyEncoding
+}
+
+func (s schema) encode() []byte {
+	buf := make([]byte, 0, 5*binary.MaxVarintLen64)
+	buf = appendUvarint(buf, s.Version)
+	buf = appendUvarint(buf, uint64(s.Layout))
+	if s.Encoding != KeyEncodingBase64 || s.Migrating {
+		buf = appendUvarint(buf, uint64(s.Encoding))
+	}
+	if s.Migrating {
+		buf = appendUvarint(buf, uint64(s.NextLayout))
+		buf = appendUvarint(buf, uint64(s.NextEncoding))
+	}
+	return buf
+}
+
+func decodeSchema(buf []byte) (schema, error) {
+	version, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return schema{}, errors.Errorf("failed to decode schema version from %v", buf)
+	}
+	layout, m := binary.Uvarint(buf[n:])
+	if m <= 0 {
+		return schema{}, errors.Errorf("failed to decode schema layout from %v", buf)
+	}
+	s := schema{Version: version, Layout: KeyLayout(layout)}
+	if n += m; n == len(buf) {
+		return s, nil //written before the key encoding was recorded
+	}
+	encoding, m := binary.Uvarint(buf[n:])
+	if m <= 0 {
+		return schema{}, errors.Errorf("failed to decode schema key encoding from %v", buf)
+	}
+	s.Encoding = KeyEncoding(encoding)
+	if n += m; n == len(buf) {
+		return s, nil
+	}
+	layout, m = binary.Uvarint(buf[n:])
+	if m <= 0 {
+		return schema{}, errors.Errorf("failed to decode schema migration from %v", buf)
+	}
+	n += m
+	encoding, m = binary.Uvarint(buf[n:])
+	if m <= 0 || n+m != len(buf) {
+		return schema{}, errors.Errorf("failed to decode schema migration from %v", buf)
+	}
+	s.Migrating, s.NextLayout, s.NextEncoding = true, KeyLayout(layout), KeyEncoding(encoding)
+	return s, nil
+}
+
+func getSchema(db datastore.Read) (schema, error) {
+	buf, err := db.Get(schemaKey)
+	if err != nil {
+		return schema{}, err
+	}
+	return decodeSchema(buf)
+}
+
+//checkSchema verifies that the store can be read with the current options,
+// the schema is written if the store has none yet.
+//An interrupted MigrateToMultihash or MigrateKeyEncoding fails with ErrMigrationInProgress,
+// it is finished by MigrateStore.
+func (c *Counted) checkSchema() error {
+	s, err := getSchema(c.ds)
+	if err == datastore.ErrNotFound {
+		s, err = c.initSchema()
+	}
+	if err != nil {
+		return err
+	}
+	if s.Version > SchemaVersion {
+		return errors.Wrapf(ErrSchemaTooNew, "store version %v, supported version %v", s.Version, SchemaVersion)
+	}
+	if s.Migrating {
+		return errors.Wrapf(ErrMigrationInProgress, "target layout %v and key encoding %v, options %v and %v",
+			s.NextLayout, s.NextEncoding, c.opt.KeyLayout, c.opt.KeyEncoding)
+	}
+	if s.Layout != c.opt.KeyLayout {
+		return errors.Wrapf(ErrLayoutMismatch, "store layout %v, option %v", s.Layout, c.opt.KeyLayout)
+	}
+	if s.Encoding != c.opt.KeyEncoding {
+		return errors.Wrapf(ErrKeyEncodingMismatch, "store key encoding %v, option %v", s.Encoding, c.opt.KeyEncoding)
+	}
+	return nil
+}
+
+//initSchema writes the schema of a store without one, a new store starts at SchemaVersion,
+// an existing store is unversioned.
+//It runs in a transaction, so the schema written by a concurrent open is kept.
+func (c *Counted) initSchema() (s schema, err error) {
+	err = c.txWarp(context.Background(), func(tx *Tx) error {
+		if s, err = getSchema(tx.transaction); err != datastore.ErrNotFound {
+			return err
+		}
+		rs, err := tx.transaction.Query(query.Query{KeysOnly: true, Limit: 1})
+		if err != nil {
+			return err
+		}
+		es, err := rs.Rest()
+		if err != nil {
+			return err
+		}
+		s = schema{Version: SchemaVersion, Layout: c.opt.KeyLayout, Encoding: c.opt.KeyEncoding}
+		if len(es) != 0 {
+			s = schema{Version: 0, Layout: LayoutCid, Encoding: KeyEncodingBase64}
+		}
+		return tx.transaction.Put(schemaKey, s.encode())
+	})
+	return s, err
+}
+
+//SchemaVersion returns the schema version of the store, it is older than SchemaVersion until Migrate completes.
+func (c *Counted) SchemaVersion() (uint64, error) {
+	s, err := getSchema(c.ds)
+	return s.Version, err
+}
+
+//Migration upgrades the schema of a store from version From to From+1.
+type Migration struct {
+	From uint64
+	Name string
+	//Run must be resumable, it is run again from the start if it was interrupted.
+	//It runs online, so the store must be readable and writable in both versions while it runs.
+	Run func(ctx context.Context, c *Counted) error
+}
+
+var migrations = struct {
+	sync.RWMutex
+	byVersion map[uint64]Migration
+}{byVersion: make(map[uint64]Migration)}
+
+//registerMigration adds the migration from a version, it panics if one is already registered.
+func registerMigration(m Migration) {
+	migrations.Lock()
+	defer migrations.Unlock()
+	if _, ok := migrations.byVersion[m.From]; ok {
+		panic(fmt.Sprintf("migration from schema version %v is already registered", m.From))
+	}
+	migrations.byVersion[m.From] = m
+}
+
+func init() {
+	registerMigration(Migration{From: 0, Name: "block sizes", Run: func(ctx context.Context, c *Counted) error {
+		_, err := c.MigrateBlockSizes(ctx)
+		return err
+	}})
+	registerMigration(Migration{From: 1, Name: "data headers", Run: func(ctx context.Context, c *Counted) error {
+		_, err := c.MigrateDataHeaders(ctx)
+		return err
+	}})
+}
+
+//MigrateStore finishes an interrupted Counted.MigrateToMultihash or Counted.MigrateKeyEncoding
+// of a store that can not be opened because of it, and runs the other migrations like Counted.Migrate.
+//opt should have the Keyring the store was written with, its KeyLayout and KeyEncoding are not used.
+//It returns the number of migrations completed.
+func MigrateStore(ctx context.Context, ds datastore.TxnDatastore, opt *DatabaseOptions) (int, error) {
+	c := newCounted(ds, opt)
+	if err := c.checkSchema(); err != nil && !errors.Is(err, ErrMigrationInProgress) {
+		return 0, err
+	}
+	return c.Migrate(ctx)
+}
+
+//Migrate runs the registered migrations from the schema version of the store up to SchemaVersion.
+//The version is saved after each migration, so an interrupted Migrate continues with the last migration.
+//It also finishes an interrupted MigrateToMultihash or MigrateKeyEncoding.
+//It returns the number of migrations completed.
+func (c *Counted) Migrate(ctx context.Context) (int, error) {
+	done := 0
+	for {
+		s, err := getSchema(c.ds)
+		if err != nil {
+			return done, err
+		}
+		if s.Migrating {
+			if _, err := c.migrateTo(ctx, s.NextLayout, s.NextEncoding); err != nil {
+				return done, err
+			}
+			done++
+			continue
+		}
+		if s.Version >= SchemaVersion {
+			return done, nil
+		}
+		migrations.RLock()
+		m, ok := migrations.byVersion[s.Version]
+		migrations.RUnlock()
+		if !ok {
+			return done, errors.Errorf("no migration from schema version %v", s.Version)
+		}
+		if err := m.Run(ctx, c); err != nil {
+			return done, errors.Wrapf(err, "migration %q from schema version %v", m.Name, m.From)
+		}
+		if err := c.txWarp(ctx, func(tx *Tx) error {
+			return tx.setSchema(func(s *schema) {
+				if s.Version == m.From {
+					s.Version++
+				}
+			})
+		}); err != nil {
+			return done, err
+		}
+		done++
+	}
+}
+
+//setSchema updates the schema of the store.
+func (c *Tx) setSchema(f func(s *schema)) error {
+	s, err := getSchema(c.transaction)
+	if err != nil {
+		return err
+	}
+	f(&s)
+	return c.transaction.Put(schemaKey, s.encode())
+}
+
+//migrateTo converts the store to another KeyLayout or KeyEncoding, the store uses them once it completes.
+//The target is saved in the schema before anything is converted, so an interrupted migration is finished
+// by MigrateStore or Migrate, and opening the store fails with ErrMigrationInProgress until then.
+//It returns the number of records converted.
+func (c *Counted) migrateTo(ctx context.Context, layout KeyLayout, encoding KeyEncoding) (int, error) {
+	if layout != LayoutMultihash && layout != c.opt.KeyLayout {
+		return 0, errors.Errorf("can not migrate to layout %v", layout)
+	}
+	var s schema
+	if err := c.txWarp(ctx, func(tx *Tx) error {
+		return tx.setSchema(func(current *schema) {
+			if !current.Migrating {
+				current.Migrating, current.NextLayout, current.NextEncoding = true, layout, encoding
+			}
+			s = *current
+		})
+	}); err != nil {
+		return 0, err
+	}
+	if s.NextLayout != layout || s.NextEncoding != encoding {
+		return 0, errors.Wrapf(ErrMigrationInProgress, "target layout %v and key encoding %v", s.NextLayout, s.NextEncoding)
+	}
+	//from is the store as it was written, to is converted one option at a time
+	from := *c
+	from.opt.KeyLayout, from.opt.KeyEncoding, from.keys = s.Layout, s.Encoding, newKeyEncoding(s.Encoding)
+	to := from
+	migrated := 0
+	if s.Encoding != encoding {
+		n, err := to.moveKeys(ctx, encoding)
+		migrated += n
+		if err != nil {
+			return migrated, err
+		}
+		to.opt.KeyEncoding, to.keys = encoding, newKeyEncoding(encoding)
+	}
+	if s.Layout != layout {
+		to.opt.KeyLayout = layout
+		n, err := to.migrateToMultihash(ctx)
+		migrated += n
+		if err != nil {
+			return migrated, err
+		}
+	}
+	if err := c.txWarp(ctx, func(tx *Tx) error {
+		if err := tx.moveScrubPosition(&from, &to); err != nil {
+			return err
+		}
+		return tx.setSchema(func(s *schema) {
+			s.Layout, s.Encoding = layout, encoding
+			s.Migrating, s.NextLayout, s.NextEncoding = false, 0, 0
+		})
+	}); err != nil {
+		return migrated, err
+	}
+	c.opt.KeyLayout, c.opt.KeyEncoding, c.keys = layout, encoding, to.keys
+	return migrated, nil
+}
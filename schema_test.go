@@ -0,0 +1,100 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/pkg/errors"
+)
+
+func TestSchema(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	f := cids[5]
+
+	//a store written before the schema was versioned
+	legacy := &Counted{keys: newKeyEncoding(KeyEncodingBase64)}
+	data, err := getter.GetBlock(ctx, f)
+	fatalIfErr(t, err)
+	fatalIfErr(t, setCount(db, legacy.getCounterKey(f), 1, metadata{Complete: true, HavePart: true}))
+	fatalIfErr(t, legacy.setData(db, f, data))
+
+	store, err := NewCountedStore(db, nil)
+	fatalIfErr(t, err)
+	version, err := store.SchemaVersion()
+	fatalIfErr(t, err)
+	if version != 0 {
+		t.Fatalf("expected an existing store to be unversioned, got version %v", version)
+	}
+	checkCounts(t, ctx, []int64{1}, []cid.Cid{f}, store)
+	n, err := store.Migrate(ctx)
+	fatalIfErr(t, err)
+	if n != SchemaVersion {
+		t.Fatalf("expected %v migrations, got %v", SchemaVersion, n)
+	}
+	if version, err = store.SchemaVersion(); version != SchemaVersion || err != nil {
+		t.Fatalf("expected version %v after migration, got %v, %v", SchemaVersion, version, err)
+	}
+	_, meta, _, err := legacy.getCount(db, f)
+	fatalIfErr(t, err)
+	if !meta.SizeKnown || meta.Size != uint64(len(data)) || !meta.Header {
+		t.Fatalf("expected migrated counter to have the block size and a data header, got %+v", meta)
+	}
+	checkCounts(t, ctx, []int64{1}, []cid.Cid{f}, store)
+	if got, err := store.GetBlock(ctx, f); err != nil || string(got) != string(data) {
+		t.Fatalf("unexpected data after migration %v", err)
+	}
+	if n, err = store.Migrate(ctx); n != 0 || err != nil {
+		t.Fatalf("expected nothing left to migrate, got %v, %v", n, err)
+	}
+
+	//a new store starts at the current version
+	db2, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db2.Close()
+	store, err = NewCountedStore(db2, &DatabaseOptions{KeyLayout: LayoutMultihash})
+	fatalIfErr(t, err)
+	if version, err = store.SchemaVersion(); version != SchemaVersion || err != nil {
+		t.Fatalf("expected new store at version %v, got %v, %v", SchemaVersion, version, err)
+	}
+	if _, err := NewCountedStore(db2, nil); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected ErrLayoutMismatch, got %v", err)
+	}
+
+	for _, want := range []schema{
+		{Version: 1},
+		{Version: 2, Encoding: KeyEncodingBinary},
+		{Version: 2, Migrating: true, NextLayout: LayoutMultihash},
+		{Version: 2, Layout: LayoutMultihash, Migrating: true, NextLayout: LayoutMultihash, NextEncoding: KeyEncodingBase32},
+	} {
+		if got, err := decodeSchema(want.encode()); got != want || err != nil {
+			t.Errorf("schema %+v decoded to %+v, %v", want, got, err)
+		}
+	}
+
+	fatalIfErr(t, db2.Put(schemaKey, schema{Version: SchemaVersion + 1, Layout: LayoutMultihash}.encode()))
+	if _, err := NewCountedStore(db2, &DatabaseOptions{KeyLayout: LayoutMultihash}); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected ErrSchemaTooNew, got %v", err)
+	}
+}
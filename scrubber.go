@@ -0,0 +1,223 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/multierr"
+)
+
+//ScrubOptions configures a Scrubber.
+type ScrubOptions struct {
+	//Interval is the minimum time between verifying two blocks, 0 for no rate limit.
+	Interval time.Duration
+	//MaxBlocks is the maximum number of blocks verified by one Run, 0 for a full pass.
+	MaxBlocks int
+	//CheckpointBlocks is the number of blocks verified between saving the position, default to 100.
+	CheckpointBlocks int
+	//BlockGetter is used to replace corrupted blocks if not nil.
+	BlockGetter BlockGetter
+	//OnMismatch is called for each corrupted block found if not nil,
+	// err is nil if the block was replaced.
+	OnMismatch func(id cid.Cid, err error)
+}
+
+//ScrubReport reports the result of a Scrubber.Run.
+type ScrubReport struct {
+	//Verified is the number of blocks hashed
+	Verified int
+	//Corrupted are the blocks that did not match their cid
+	Corrupted []cid.Cid
+	//Repaired are the corrupted blocks replaced from ScrubOptions.BlockGetter
+	Repaired []cid.Cid
+	//Complete is true if the end of the store is reached, the next Run will start from the beginning
+	Complete bool
+}
+
+//Scrubber re-verifies stored blocks against their cids to find corrupted data.
+//The position is persisted, so scrubbing continues where the last Run stopped.
+type Scrubber struct {
+	store *Counted
+	opt   ScrubOptions
+}
+
+var scrubPositionKey = datastore.NewKey("/scrub/position")
+
+//moveScrubPosition rewrites the saved position, which is the key of the data of a block in from,
+// to the key of the same data in to. Keys of other encodings sort differently,
+// so the next Run continues from that block but may verify other blocks again or later.
+func (c *Tx) moveScrubPosition(from, to *Counted) error {
+	position, err := c.transaction.Get(scrubPositionKey)
+	if err == datastore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	id, err := from.keyToCid(string(position), dataSuffixKey)
+	if err != nil {
+		return c.transaction.Delete(scrubPositionKey) //start over
+	}
+	return c.transaction.Put(scrubPositionKey, []byte(to.dataKey(id).String()))
+}
+
+//NewScrubber creates a Scrubber for the blocks in the store.
+func NewScrubber(store *Counted, opt *ScrubOptions) *Scrubber {
+	if opt == nil {
+		opt = &ScrubOptions{}
+	}
+	s := &Scrubber{
+		store: store,
+		opt:   *opt,
+	}
+	if s.opt.CheckpointBlocks <= 0 {
+		s.opt.CheckpointBlocks = 100
+	}
+	return s
+}
+
+//Run verifies blocks from the last saved position until the end of the store, MaxBlocks
+// is reached or ctx is canceled.
+func (s *Scrubber) Run(ctx context.Context) (report ScrubReport, err error) {
+	position, err := s.store.ds.Get(scrubPositionKey)
+	if err != nil && err != datastore.ErrNotFound {
+		return report, err
+	}
+	it := &ckiter{store: s.store, suffix: dataSuffixKey} //data is verified by its data id
+	it.rs, it.err = s.store.ds.Query(query.Query{
+		Filters: []query.Filter{it, query.FilterKeyCompare{
+			Op:  query.GreaterThan,
+			Key: string(position),
+		}},
+		Orders:   []query.Order{query.OrderByKey{}},
+		KeysOnly: true,
+	})
+	if it.err != nil {
+		return report, it.err
+	}
+	defer func() {
+		err = multierr.Combine(err, it.rs.Close())
+	}()
+	var ticker *time.Ticker
+	if s.opt.Interval > 0 {
+		ticker = time.NewTicker(s.opt.Interval)
+		defer ticker.Stop()
+	}
+	var last string
+	checkpoint := func() error {
+		if last == "" {
+			return nil
+		}
+		return s.store.ds.Put(scrubPositionKey, []byte(last))
+	}
+	for r := range it.rs.Next() {
+		if r.Error != nil {
+			return report, multierr.Combine(r.Error, checkpoint())
+		}
+		if s.opt.MaxBlocks > 0 && report.Verified >= s.opt.MaxBlocks {
+			return report, checkpoint()
+		}
+		if ticker != nil {
+			select {
+			case <-ctx.Done():
+				return report, multierr.Combine(ctx.Err(), checkpoint())
+			case <-ticker.C:
+			}
+		} else if ctx.Err() != nil {
+			return report, multierr.Combine(ctx.Err(), checkpoint())
+		}
+		id, err := s.store.keyToCid(r.Key, dataSuffixKey)
+		if err != nil {
+			continue
+		}
+		if err := s.verify(ctx, id, &report); err != nil {
+			return report, multierr.Combine(err, checkpoint())
+		}
+		last = r.Key
+		report.Verified++
+		if report.Verified%s.opt.CheckpointBlocks == 0 {
+			if err := checkpoint(); err != nil {
+				return report, err
+			}
+		}
+	}
+	report.Complete = true
+	return report, s.store.ds.Delete(scrubPositionKey)
+}
+
+//verify checks a stored block, data that fails to decompress or decrypt is corrupted like data
+// that does not match its cid.
+func (s *Scrubber) verify(ctx context.Context, id cid.Cid, report *ScrubReport) error {
+	key := s.store.dataKey(id)
+	value, err := s.store.ds.Get(key)
+	if err == datastore.ErrNotFound {
+		return nil //removed since listed
+	}
+	if err != nil {
+		return err
+	}
+	_, meta, _, err := s.store.getBlockMeta(s.store.ds, id)
+	if err != nil {
+		return err
+	}
+	data, mismatch := s.store.decodeData(key, value, meta)
+	if mismatch == nil {
+		mismatch = verifyBlock(id, data)
+	}
+	if mismatch == nil {
+		return nil
+	}
+	report.Corrupted = append(report.Corrupted, id)
+	if s.opt.BlockGetter != nil {
+		if mismatch = s.repair(ctx, id); mismatch == nil {
+			report.Repaired = append(report.Repaired, id)
+		}
+	}
+	if s.opt.OnMismatch != nil {
+		s.opt.OnMismatch(id, mismatch)
+	}
+	return nil
+}
+
+//repair replaces a corrupted block if it is still stored
+func (s *Scrubber) repair(ctx context.Context, id cid.Cid) error {
+	data, err := s.opt.BlockGetter.GetBlock(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := verifyBlock(id, data); err != nil {
+		return err
+	}
+	return s.store.txWarp(ctx, func(tx *Tx) error {
+		has, err := tx.transaction.Has(s.store.dataKey(id))
+		if !has || err != nil {
+			return err
+		}
+		count, meta, key, err := s.store.getBlockMeta(tx.transaction, id)
+		if err != nil {
+			return err
+		}
+		stored, err := tx.putData(id, data)
+		if err != nil || count == 0 {
+			return err
+		}
+		return setCount(tx.transaction, key, count, meta.withBlock(stored))
+	})
+}
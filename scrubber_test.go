@@ -0,0 +1,130 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+)
+
+func TestScrubber(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	store, err := NewCountedStore(db, nil)
+	fatalIfErr(t, err)
+	ctx := context.Background()
+
+	_, err = store.Increment(ctx, cids[1], getter)
+	fatalIfErr(t, err)
+	fatalIfErr(t, store.setData(db, cids[5], []byte("bit rot")))
+
+	var mismatches []cid.Cid
+	s := NewScrubber(store, &ScrubOptions{
+		MaxBlocks:        3,
+		CheckpointBlocks: 1,
+		OnMismatch: func(id cid.Cid, err error) {
+			if err == nil {
+				t.Errorf("expected error for unrepaired block %v", id)
+			}
+			mismatches = append(mismatches, id)
+		},
+	})
+	report, err := s.Run(ctx)
+	fatalIfErr(t, err)
+	if report.Verified != 3 || report.Complete {
+		t.Errorf("unexpected report %+v", report)
+	}
+	first := len(report.Corrupted)
+	//continues from the saved position
+	report, err = s.Run(ctx)
+	fatalIfErr(t, err)
+	if report.Verified != 1 || !report.Complete {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if first+len(report.Corrupted) != 1 || len(mismatches) != 1 || mismatches[0] != cids[5] {
+		t.Errorf("expected %v to be corrupted, got %v", cids[5], mismatches)
+	}
+
+	s = NewScrubber(store, &ScrubOptions{BlockGetter: getter})
+	report, err = s.Run(ctx)
+	fatalIfErr(t, err)
+	if report.Verified != 4 || len(report.Repaired) != 1 || report.Repaired[0] != cids[5] {
+		t.Errorf("unexpected report %+v", report)
+	}
+	report, err = s.Run(ctx)
+	fatalIfErr(t, err)
+	if report.Verified != 4 || len(report.Corrupted) != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+func TestScrubberUndecodable(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	keys, err := NewAESKeyring(1, bytes.Repeat([]byte{1}, 32))
+	fatalIfErr(t, err)
+	store, err := NewCountedStore(db, &DatabaseOptions{Keyring: keys})
+	fatalIfErr(t, err)
+	ctx := context.Background()
+
+	_, err = store.Increment(ctx, cids[1], getter)
+	fatalIfErr(t, err)
+	//bit rot in encrypted data fails to open
+	value, err := db.Get(store.dataKey(cids[5]))
+	fatalIfErr(t, err)
+	value[len(value)-1] ^= 1
+	fatalIfErr(t, db.Put(store.dataKey(cids[5]), value))
+
+	var mismatches []cid.Cid
+	s := NewScrubber(store, &ScrubOptions{
+		OnMismatch: func(id cid.Cid, err error) {
+			mismatches = append(mismatches, id)
+		},
+	})
+	report, err := s.Run(ctx)
+	fatalIfErr(t, err)
+	if report.Verified != 4 || !report.Complete || len(report.Corrupted) != 1 || report.Corrupted[0] != cids[5] {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if len(mismatches) != 1 || mismatches[0] != cids[5] {
+		t.Errorf("expected %v to be corrupted, got %v", cids[5], mismatches)
+	}
+
+	s = NewScrubber(store, &ScrubOptions{BlockGetter: getter})
+	report, err = s.Run(ctx)
+	fatalIfErr(t, err)
+	if len(report.Repaired) != 1 || report.Repaired[0] != cids[5] {
+		t.Errorf("unexpected report %+v", report)
+	}
+	data, err := store.GetBlock(ctx, cids[5])
+	fatalIfErr(t, err)
+	want, err := getter.GetBlock(ctx, cids[5])
+	fatalIfErr(t, err)
+	if !bytes.Equal(data, want) {
+		t.Error("unexpected data after repair")
+	}
+}
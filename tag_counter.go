@@ -16,10 +16,13 @@ package sharedforeststore
 
 import (
 	"context"
+	"io"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/zap"
 )
 
 //TagCounted supports both TagStore and CounterStore interfaces.
@@ -31,45 +34,76 @@ type TagCounted struct {
 var _ TagCounterStore = (*TagCounted)(nil)
 
 //NewTagCountedStore creates a new TagCounted from a transactional datastore.
-func NewTagCountedStore(db datastore.TxnDatastore, opt *DatabaseOptions) *TagCounted {
-	cs := NewCountedStore(db, opt)
+func NewTagCountedStore(db datastore.TxnDatastore, opt *DatabaseOptions) (*TagCounted, error) {
+	cs, err := NewCountedStore(db, opt)
+	if err != nil {
+		return nil, err
+	}
 	return &TagCounted{
 		Counted: *cs,
-	}
+	}, nil
 }
 
-//txPutTag returns true if a new tag was added
-func txPutTag(tx datastore.Txn, id cid.Cid, tag datastore.Key) (bool, error) {
-	idtag := getTagKey(id, tag)
-	if _, err := tx.Get(idtag); err != datastore.ErrNotFound {
+//putTag returns true if a new tag was added
+func (c *Tx) putTag(id cid.Cid, tag datastore.Key) (bool, error) {
+	id = c.store.normalize(id)
+	if _, has, err := c.store.findTag(c.transaction, id, tag); has || err != nil {
 		//tag already added, or some other error occurred
 		return false, err
 	}
-	if err := tx.Put(idtag, nil); err != nil {
+	idtag := c.store.tagKey(id, tag)
+	value, err := c.store.tagValue(idtag, tag)
+	if err != nil {
+		return false, err
+	}
+	if err := c.transaction.Put(idtag, value); err != nil {
+		return false, err
+	}
+	if err := c.record(Change{Kind: ChangeTagPut, Cid: id, Tag: tag}); err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
 func (c *TagCounted) PutTag(ctx context.Context, id cid.Cid, tag datastore.Key, bg BlockGetter) error {
+	defer observeSince(c.metrics.putTag, time.Now())
 	return c.txWarp(ctx, func(tx *Tx) error {
-		put, err := txPutTag(tx.transaction, id, tag)
-		if !put {
-			return err
-		}
-		_, err = tx.increment(id, bg, c.opt.LinkDecoder)
-		return err
+		return tx.PutTag(id, tag, bg)
 	})
 }
 
+//PutTag is TagCounted.PutTag as part of the transaction.
+func (c *Tx) PutTag(id cid.Cid, tag datastore.Key, bg BlockGetter) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	put, err := c.putTag(id, tag)
+	if !put {
+		return err
+	}
+	_, err = c.Increment(id, bg)
+	return err
+}
+
 func (c *TagCounted) HasTag(ctx context.Context, id cid.Cid, tag datastore.Key) (bool, error) {
-	return c.ds.Has(getTagKey(id, tag))
+	_, has, err := c.findTag(c.ds, id, tag)
+	return has, err
+}
+
+//HasTag is TagCounted.HasTag as part of the transaction.
+func (c *Tx) HasTag(id cid.Cid, tag datastore.Key) (bool, error) {
+	if err := c.Err(); err != nil {
+		return false, err
+	}
+	_, has, err := c.store.findTag(c.transaction, id, tag)
+	return has, err
 }
 
 func (c *TagCounted) GetTags(ctx context.Context, id cid.Cid) ([]datastore.Key, error) {
-	prefix := newKeyFromCid(id, tagSuffixKey)
+	id = c.normalize(id)
+	prefix := c.keys.tailPrefix(id, tagSuffixKey)
 	rs, err := c.ds.Query(query.Query{
-		Filters:  []query.Filter{query.FilterKeyPrefix{Prefix: prefix.String()}},
+		Filters:  []query.Filter{query.FilterKeyPrefix{Prefix: prefix}},
 		KeysOnly: true,
 	})
 	if err != nil {
@@ -79,28 +113,134 @@ func (c *TagCounted) GetTags(ctx context.Context, id cid.Cid) ([]datastore.Key,
 	if err != nil {
 		return nil, err
 	}
-	ps := len(prefix.String())
+	ps := len(prefix) - 1 //tags start with the last "/" of the prefix
 	tags := make([]datastore.Key, len(es))
 	for i, e := range es {
 		tags[i] = datastore.RawKey(e.Key[ps:])
 	}
+	if c.opt.TagHashKey == nil {
+		return tags, nil
+	}
+	rs, err = c.ds.Query(query.Query{
+		Filters: []query.Filter{query.FilterKeyPrefix{Prefix: c.keys.tailPrefix(id, hashedTagSuffixKey)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if es, err = rs.Rest(); err != nil {
+		return nil, err
+	}
+	for _, e := range es {
+		_, tag, err := c.decodeTag(e.Key, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
 	return tags, nil
 }
 
+//TagIterator is an iterator of tags.
+type TagIterator interface {
+	//NextTag returns the next tag and the cid it is put on, or io.EOF if the end is reached
+	NextTag() (cid.Cid, datastore.Key, error)
+	//Close releases the resources used by this iterator for early exist
+	Close() error
+}
+
+type tagIter struct {
+	store *Counted
+	rs    query.Results
+	err   error
+}
+
+func (c *tagIter) NextTag() (cid.Cid, datastore.Key, error) {
+	if c.err != nil {
+		return cid.Undef, datastore.Key{}, c.err
+	}
+	r, more := c.rs.NextSync()
+	if r.Error != nil {
+		return cid.Undef, datastore.Key{}, r.Error
+	}
+	if !more {
+		c.err = io.EOF
+		return cid.Undef, datastore.Key{}, c.err
+	}
+	return c.store.decodeTag(r.Key, r.Value)
+}
+
+func (c *tagIter) Filter(e query.Entry) bool {
+	_, err := c.store.tagKeyCid(e.Key)
+	return err == nil
+}
+
+func (c *tagIter) Close() error {
+	if c.rs == nil {
+		return c.err
+	}
+	return c.rs.Close()
+}
+
+//TagsIterator iterates all tags in the store, for administrative tasks such as replication.
+//Like GetTags, this function should be hidden from public facing APIs.
+func (c *TagCounted) TagsIterator() TagIterator {
+	it := &tagIter{store: &c.Counted}
+	it.rs, it.err = c.ds.Query(query.Query{
+		Filters: []query.Filter{it},
+	})
+	return it
+}
+
 func (c *TagCounted) RemoveTag(ctx context.Context, id cid.Cid, tag datastore.Key) error {
-	tk := getTagKey(id, tag)
+	defer observeSince(c.metrics.removeTag, time.Now())
 	return c.txWarp(ctx, func(tx *Tx) error {
-		has, err := tx.transaction.Has(tk)
-		if err != nil {
-			return err
-		}
-		if !has {
-			return nil
-		}
-		if err = tx.transaction.Delete(tk); err != nil {
-			return err
-		}
-		_, err = tx.decrement(id, c.opt.LinkDecoder)
+		return tx.RemoveTag(id, tag)
+	})
+}
+
+//RemoveTag is TagCounted.RemoveTag as part of the transaction.
+func (c *Tx) RemoveTag(id cid.Cid, tag datastore.Key) error {
+	if err := c.Err(); err != nil {
 		return err
+	}
+	id = c.store.normalize(id)
+	tk, has, err := c.store.findTag(c.transaction, id, tag)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return nil
+	}
+	if err = c.transaction.Delete(tk); err != nil {
+		return err
+	}
+	if err := c.record(Change{Kind: ChangeTagRemoved, Cid: id, Tag: tag}); err != nil {
+		return err
+	}
+	count, err := c.Decrement(id)
+	if err == nil && count == 0 && c.store.logs(zap.InfoLevel) {
+		c.logOnCommit(zap.InfoLevel, "root deleted", cidField(id))
+	}
+	return err
+}
+
+//UpdateTag moves a tag from oldID to newID in a single transaction.
+//Only blocks not already stored are requested from BlockGetter, and blocks shared
+// by both DAGs are never removed since the new tag is added before the old one is removed.
+//If oldID is not tagged, UpdateTag only adds the tag to newID, so it is safe to retry.
+func (c *TagCounted) UpdateTag(ctx context.Context, tag datastore.Key, oldID, newID cid.Cid, bg BlockGetter) error {
+	return c.txWarp(ctx, func(tx *Tx) error {
+		return tx.UpdateTag(tag, oldID, newID, bg)
 	})
 }
+
+//UpdateTag is TagCounted.UpdateTag as part of the transaction.
+func (c *Tx) UpdateTag(tag datastore.Key, oldID, newID cid.Cid, bg BlockGetter) error {
+	if err := c.PutTag(newID, tag, bg); err != nil {
+		return err
+	}
+	if c.store.normalize(oldID).Equals(c.store.normalize(newID)) {
+		return nil //both are keyed the same in LayoutMultihash
+	}
+	return c.RemoveTag(oldID, tag)
+}
@@ -48,7 +48,8 @@ func TestTagCounter(t *testing.T) {
 	db, err := leveldb.NewDatastore("", nil)
 	fatalIfErr(t, err)
 	defer db.Close()
-	store := NewTagCountedStore(db, nil)
+	store, err := NewTagCountedStore(db, nil)
+	fatalIfErr(t, err)
 	ctx := context.Background()
 
 	for _, c := range tagCases {
@@ -67,12 +68,83 @@ func TestTagCounter(t *testing.T) {
 	checkFullStoreByIterator(t, ctx, nil, store)
 }
 
+func TestTagUpdate(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	store, err := NewTagCountedStore(db, nil)
+	fatalIfErr(t, err)
+	ctx := context.Background()
+	tag := datastore.NewKey("tag")
+
+	fatalIfErr(t, store.PutTag(ctx, cids[0], tag, getter))
+	fatalIfErr(t, store.Update(ctx, func(tx *Tx) error {
+		if err := tx.PutTag(cids[2], tag, getter); err != nil {
+			return err
+		}
+		if has, err := tx.HasTag(cids[0], tag); !has || err != nil {
+			t.Errorf("expected tag in transaction, got %v, %v", has, err)
+		}
+		return tx.RemoveTag(cids[0], tag)
+	}))
+	checkCounts(t, ctx, []int64{0, 0, 1, 0, 1, 2}, cids, store)
+	checkTags(t, ctx, cids[0], nil, store)
+	checkTags(t, ctx, cids[2], []string{"tag"}, store)
+}
+
+//recordingBlockGetter records the cids requested from it
+type recordingBlockGetter struct {
+	BlockGetter
+	requested []cid.Cid
+}
+
+func (g *recordingBlockGetter) GetBlock(ctx context.Context, id cid.Cid) ([]byte, error) {
+	g.requested = append(g.requested, id)
+	return g.BlockGetter.GetBlock(ctx, id)
+}
+
+func TestUpdateTag(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	store, err := NewTagCountedStore(db, nil)
+	fatalIfErr(t, err)
+	ctx := context.Background()
+	tag := datastore.NewKey("tag")
+
+	fatalIfErr(t, store.PutTag(ctx, cids[0], tag, getter))
+	rg := &recordingBlockGetter{BlockGetter: getter}
+	//B shares D and F with A, so only B and E are fetched
+	fatalIfErr(t, store.UpdateTag(ctx, tag, cids[0], cids[1], rg))
+	checkCounts(t, ctx, []int64{0, 1, 0, 1, 1, 3}, cids, store)
+	checkTags(t, ctx, cids[0], nil, store)
+	checkTags(t, ctx, cids[1], []string{"tag"}, store)
+	if len(rg.requested) != 2 || rg.requested[0] != cids[1] || rg.requested[1] != cids[4] {
+		t.Errorf("expected only B and E to be fetched, got %v", rg.requested)
+	}
+
+	//retrying the update is a no-op
+	fatalIfErr(t, store.UpdateTag(ctx, tag, cids[0], cids[1], getter))
+	checkCounts(t, ctx, []int64{0, 1, 0, 1, 1, 3}, cids, store)
+
+	fatalIfErr(t, store.UpdateTag(ctx, tag, cids[1], cids[1], getter))
+	checkCounts(t, ctx, []int64{0, 1, 0, 1, 1, 3}, cids, store)
+	checkFullStoreByIterator(t, ctx, []cid.Cid{cids[1], cids[3], cids[4], cids[5]}, store)
+}
+
 func BenchmarkPutTag(b *testing.B) {
 	cids, getter := setup(b)
 	db, err := leveldb.NewDatastore("", nil)
 	fatalIfErr(b, err)
 	defer db.Close()
-	store := NewTagCountedStore(db, nil)
+	store, err := NewTagCountedStore(db, nil)
+	fatalIfErr(b, err)
 	ctx := context.Background()
 	id := cids[1]
 	tag := datastore.NewKey("tag")
@@ -88,7 +160,8 @@ func BenchmarkPutTag_P8(b *testing.B) {
 	db, err := leveldb.NewDatastore("", nil)
 	fatalIfErr(b, err)
 	defer db.Close()
-	store := NewTagCountedStore(db, nil)
+	store, err := NewTagCountedStore(db, nil)
+	fatalIfErr(b, err)
 	ctx := context.Background()
 	tag := datastore.NewKey("tag")
 	id := cids[1]
@@ -115,7 +188,8 @@ func BenchmarkPutRemoveTag(b *testing.B) {
 	db, err := leveldb.NewDatastore("", nil)
 	fatalIfErr(b, err)
 	defer db.Close()
-	store := NewTagCountedStore(db, nil)
+	store, err := NewTagCountedStore(db, nil)
+	fatalIfErr(b, err)
 	ctx := context.Background()
 	id := cids[1]
 	tag := datastore.NewKey("tag")
@@ -132,7 +206,8 @@ func BenchmarkPutRemoveTag_P8(b *testing.B) {
 	db, err := leveldb.NewDatastore("", nil)
 	fatalIfErr(b, err)
 	defer db.Close()
-	store := NewTagCountedStore(db, nil)
+	store, err := NewTagCountedStore(db, nil)
+	fatalIfErr(b, err)
 	ctx := context.Background()
 	id := cids[1]
 	wg := sync.WaitGroup{}
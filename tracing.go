@@ -0,0 +1,118 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	"go.uber.org/multierr"
+)
+
+//noSpan is returned instead of a span when nothing is traced.
+var noSpan = opentracing.NoopTracer{}.StartSpan("")
+
+//startSpan starts a span as a child of the span in ctx, with the tracer of that span so spans
+// follow the caller even if the global tracer is not set.
+//Spans are only traced as part of a caller's trace, without a span in ctx, ctx is returned with noSpan.
+func startSpan(ctx context.Context, operation string, opts ...opentracing.StartSpanOption) (opentracing.Span, context.Context) {
+	return startTaggedSpan(ctx, operation, func() []opentracing.StartSpanOption {
+		return opts
+	})
+}
+
+//startTaggedSpan is startSpan with options that are only built if the span is traced,
+// so steps on the hot path do not format tags for nothing.
+func startTaggedSpan(ctx context.Context, operation string, opts func() []opentracing.StartSpanOption) (opentracing.Span, context.Context) {
+	parent := opentracing.SpanFromContext(ctx)
+	if parent == nil {
+		return noSpan, ctx
+	}
+	return opentracing.StartSpanFromContextWithTracer(ctx, parent.Tracer(), "sharedforeststore."+operation, opts()...)
+}
+
+//startCidSpan starts a span of a step on a block, depth is not tagged if it is negative.
+func startCidSpan(ctx context.Context, operation string, id cid.Cid, depth int) (opentracing.Span, context.Context) {
+	return startTaggedSpan(ctx, operation, func() []opentracing.StartSpanOption {
+		if depth < 0 {
+			return []opentracing.StartSpanOption{cidTag(id)}
+		}
+		return []opentracing.StartSpanOption{cidTag(id), depthTag(depth)}
+	})
+}
+
+func cidTag(id cid.Cid) opentracing.Tag {
+	return opentracing.Tag{Key: "cid", Value: id.String()}
+}
+
+func depthTag(depth int) opentracing.Tag {
+	return opentracing.Tag{Key: "depth", Value: depth}
+}
+
+//finishSpan marks the span as failed if err is not nil and finishes it.
+func finishSpan(span opentracing.Span, err error) {
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(log.Error(err))
+	}
+	span.Finish()
+}
+
+//txSpan is a span of a step of a transaction, the transaction context is the context of the span until it finishes.
+type txSpan struct {
+	opentracing.Span
+	tx     *Tx
+	parent context.Context
+}
+
+//startSpan starts a span of a recursive step of the transaction, depth is the recursion depth.
+func (c *Tx) startSpan(operation string, id cid.Cid) txSpan {
+	span, ctx := startCidSpan(c.Context, operation, id, c.depth)
+	s := txSpan{Span: span, tx: c, parent: c.Context}
+	c.Context = ctx
+	c.depth++
+	return s
+}
+
+func (s txSpan) finish(err error) {
+	s.tx.depth--
+	s.tx.Context = s.parent
+	finishSpan(s.Span, err)
+}
+
+//attempt runs f and commits the transaction, it returns the error of f and the commit error.
+//Each attempt has a span tagged with its retry number.
+func (c *Tx) attempt(ctx context.Context, f func(tx *Tx) error, retry int) (fError error, commitError error) {
+	span, spanCtx := startTaggedSpan(ctx, "tx", func() []opentracing.StartSpanOption {
+		return []opentracing.StartSpanOption{opentracing.Tag{Key: "retry", Value: retry}}
+	})
+	defer func() {
+		finishSpan(span, multierr.Combine(fError, commitError))
+	}()
+	c.Context = spanCtx
+	defer func() {
+		c.Context = ctx
+	}()
+	if fError = f(c); fError != nil {
+		return fError, nil
+	}
+	commit, _ := startSpan(spanCtx, "commit")
+	commitError = c.transaction.Commit()
+	finishSpan(commit, commitError)
+	return nil, commitError
+}
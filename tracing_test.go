@@ -0,0 +1,113 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestTracing(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	tracer := mocktracer.New()
+	root := tracer.StartSpan("test")
+	ctx := opentracing.ContextWithSpan(context.Background(), root)
+
+	store, err := NewProgressiveTagCountedStore(db, nil)
+	fatalIfErr(t, err)
+	fatalIfErr(t, store.PutTag(ctx, cids[0], datastore.NewKey("tagA"), getter))
+	fatalIfErr(t, store.ProgressivePutTag(ctx, cids[1], datastore.NewKey("tagB"), getter).Run(ctx))
+	root.Finish()
+
+	spans := tracer.FinishedSpans()
+	byID := make(map[int]*mocktracer.MockSpan)
+	ops := make(map[string]int)
+	for _, span := range spans {
+		byID[span.SpanContext.SpanID] = span
+		ops[span.OperationName]++
+		if span.SpanContext.TraceID != root.Context().(mocktracer.MockSpanContext).TraceID {
+			t.Errorf("span %v is not in the trace of the caller", span.OperationName)
+		}
+	}
+	//a, d and f by PutTag, ProgressivePutTag uses progressTx
+	if ops["sharedforeststore.increment"] != 3 {
+		t.Errorf("expected 3 increment spans, got %v", ops)
+	}
+	//b and e are stored by ProgressivePutTag, d is already stored
+	if ops["sharedforeststore.GetBlock"] != 5 {
+		t.Errorf("expected 5 GetBlock spans, got %v", ops)
+	}
+	if ops["sharedforeststore.progressTx"] != 3 {
+		t.Errorf("expected 3 progressTx spans, got %v", ops)
+	}
+	if ops["sharedforeststore.commit"] != ops["sharedforeststore.tx"] {
+		t.Errorf("expected a commit span for each transaction, got %v", ops)
+	}
+	for _, span := range spans {
+		if span.OperationName != "sharedforeststore.increment" || span.Tag("cid") != cids[5].String() {
+			continue
+		}
+		if depth := span.Tag("depth"); depth != 2 {
+			t.Errorf("expected increment of f at depth 2, got %v", depth)
+		}
+		//f is incremented by d, which is incremented by a in the transaction
+		var path []string
+		for p := byID[span.ParentID]; p != nil; p = byID[p.ParentID] {
+			path = append(path, p.OperationName)
+		}
+		want := []string{"sharedforeststore.increment", "sharedforeststore.increment", "sharedforeststore.tx", "test"}
+		if len(path) != len(want) {
+			t.Fatalf("expected parents %v, got %v", want, path)
+		}
+		for i := range want {
+			if path[i] != want[i] {
+				t.Fatalf("expected parents %v, got %v", want, path)
+			}
+		}
+	}
+	for _, span := range spans {
+		if span.OperationName == "sharedforeststore.tx" && span.Tag("retry") != 0 {
+			t.Errorf("expected transactions without conflicts to have retry 0, got %v", span.Tag("retry"))
+		}
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	cids, _ := setup(t)
+	tx := &Tx{Context: context.Background()}
+	//without a span in the context, steps do not build spans
+	allocs := testing.AllocsPerRun(100, func() {
+		span := tx.startSpan("increment", cids[0])
+		s, ctx := startCidSpan(tx.Context, "GetBlock", cids[1], -1)
+		finishSpan(s, nil)
+		if ctx != tx.Context {
+			t.Fatal("expected the context to be kept without tracing")
+		}
+		span.finish(nil)
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations without tracing, got %v", allocs)
+	}
+}
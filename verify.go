@@ -0,0 +1,65 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+//HashMismatchError is returned when the data of a block does not match the hash in its cid.
+type HashMismatchError struct {
+	//Cid is the requested cid
+	Cid cid.Cid
+	//Got is the cid computed from the data
+	Got cid.Cid
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("hash mismatch for block %v, data hashed to %v", e.Cid, e.Got)
+}
+
+//verifyBlock returns a HashMismatchError if data does not hash to id
+func verifyBlock(id cid.Cid, data []byte) error {
+	got, err := id.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !got.Equals(id) {
+		return &HashMismatchError{Cid: id, Got: got}
+	}
+	return nil
+}
+
+//fetchBlock gets a block from an untrusted BlockGetter and verifies it unless disabled by options
+func (c *Counted) fetchBlock(ctx context.Context, bg BlockGetter, id cid.Cid) ([]byte, error) {
+	span, ctx := startCidSpan(ctx, "GetBlock", id, -1)
+	start := time.Now()
+	data, err := bg.GetBlock(ctx, id)
+	observeSince(c.metrics.fetch, start)
+	finishSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	if !c.opt.SkipHashVerification {
+		if err := verifyBlock(id, data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 RTrade Technologies Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharedforeststore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/pkg/errors"
+)
+
+func TestVerifyBlocks(t *testing.T) {
+	t.Parallel()
+
+	cids, getter := setup(t)
+	ctx := context.Background()
+	tag := datastore.NewKey("tag")
+	poisoned := make(mapBlockGetter)
+	for _, id := range cids {
+		var err error
+		poisoned[id], err = getter.GetBlock(ctx, id)
+		fatalIfErr(t, err)
+	}
+	poisoned[cids[5]] = []byte("evil")
+
+	db, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db.Close()
+	store, err := NewProgressiveTagCountedStore(db, nil)
+	fatalIfErr(t, err)
+
+	var mismatch *HashMismatchError
+	err = store.PutTag(ctx, cids[0], tag, poisoned)
+	if !errors.As(err, &mismatch) || mismatch.Cid != cids[5] {
+		t.Fatalf("expected hash mismatch of %v, got %v", cids[5], err)
+	}
+	checkCounts(t, ctx, make([]int64, len(cids)), cids, store)
+	err = store.ProgressivePutTag(ctx, cids[0], tag, poisoned).Run(ctx)
+	if !errors.As(err, &mismatch) || mismatch.Cid != cids[5] {
+		t.Fatalf("expected hash mismatch of %v, got %v", cids[5], err)
+	}
+	fatalIfErr(t, store.RemoveTag(ctx, cids[0], tag))
+	checkFullStoreByIterator(t, ctx, nil, store)
+
+	db2, err := leveldb.NewDatastore("", nil)
+	fatalIfErr(t, err)
+	defer db2.Close()
+	unverified, err := NewTagCountedStore(db2, &DatabaseOptions{SkipHashVerification: true})
+	fatalIfErr(t, err)
+	fatalIfErr(t, unverified.PutTag(ctx, cids[0], tag, poisoned))
+	checkCounts(t, ctx, []int64{1, 0, 0, 1, 0, 1}, cids, unverified)
+}